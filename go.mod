@@ -1,3 +1,9 @@
 module github.com/Joker-Jane/JSON-replacement
 
 go 1.19
+
+require (
+	github.com/klauspost/compress v1.16.7
+	golang.org/x/crypto v0.17.0
+	gopkg.in/yaml.v3 v3.0.1
+)
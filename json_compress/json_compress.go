@@ -0,0 +1,320 @@
+/*
+This package reads compressed input files and writes compressed output files.
+It is shared by json_replace, json_select and json_flat so that all of them accept the same inputs.
+
+Input files compressed by gzip, bzip2 or zstd are detected by their magic bytes, or by their extensions
+.gz, .bz2 and .zst, and decompressed while they are read.
+Other input files are read as they are.
+
+Output files are compressed by gzip or zstd if asked. Target returns the path of an output derived from
+an input file, without the extension of compression of the input, and with the extension of the format
+of the output if it is compressed, so that events.json.gz is written to events.json unless outputs are
+compressed, and events.json is written to events.json.zst if they are compressed by zstd.
+Output paths given explicitly are written as they are.
+
+The path - stands for stdin as an input, and for stdout as an output. Stdin is decompressed
+if it starts with magic bytes, and stdout is compressed in the same way as output files,
+but neither of them is closed.
+*/
+package json_compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Formats of compression of outputs
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Path of stdin as an input, or stdout as an output
+const Stdio = "-"
+
+// format struct represents a format of compression of input files, and of output files if it has a writer
+type format struct {
+	name      string
+	extension string
+	magic     []byte
+	reader    func(io.Reader) (io.ReadCloser, error)
+	writer    func(io.Writer) (io.WriteCloser, error)
+}
+
+// Formats of compression of input files
+var formats = []*format{
+	{
+		name:      Gzip,
+		extension: ".gz",
+		magic:     []byte{0x1f, 0x8b},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	},
+	{
+		name:      "bzip2",
+		extension: ".bz2",
+		magic:     []byte("BZh"),
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		},
+	},
+	{
+		name:      Zstd,
+		extension: ".zst",
+		magic:     []byte{0x28, 0xb5, 0x2f, 0xfd},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	},
+}
+
+// Return the format of compression of outputs by its name, which is nil if outputs are not compressed
+func output(compression string) (*format, error) {
+	if compression == "" {
+		return nil, nil
+	}
+	for _, c := range formats {
+		if c.name == compression && c.writer != nil {
+			return c, nil
+		}
+	}
+	return nil, errors.New("Unknown format of compression '" + compression + "', which must be " + Gzip + " or " + Zstd)
+}
+
+// Check that outputs can be compressed in the format, which is empty if outputs are not compressed
+func Check(compression string) error {
+	_, err := output(compression)
+	return err
+}
+
+// Compression is a flag of the format of compression of outputs, which is empty if outputs are not compressed
+// Its value is optional, so that -g compresses outputs by gzip and -g=zstd compresses them by zstd
+type Compression string
+
+// Return the format of compression
+func (c *Compression) String() string {
+	return string(*c)
+}
+
+// Set the format of compression from the value of the flag
+func (c *Compression) Set(value string) error {
+	switch value {
+	case "true":
+		value = Gzip
+	case "false":
+		value = ""
+	}
+	err := Check(value)
+	if err != nil {
+		return err
+	}
+	*c = Compression(value)
+	return nil
+}
+
+// The flag can be given without a value
+func (c *Compression) IsBoolFlag() bool {
+	return true
+}
+
+// reader struct reads a decompressed input file, and closes the file when it is closed unless it is stdin
+type reader struct {
+	io.Reader
+	decompressor io.Closer
+	file         *os.File
+}
+
+// Close the decompressor and the input file
+func (r *reader) Close() error {
+	var err error
+	if r.decompressor != nil {
+		err = r.decompressor.Close()
+	}
+	if r.file == os.Stdin {
+		return err
+	}
+	closeErr := r.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Open an input file, or stdin if the path is -, which is decompressed while it is read if it is compressed
+func Open(path string) (io.ReadCloser, error) {
+	f := os.Stdin
+	if path != Stdio {
+		var err error
+		f, err = os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	buffered := bufio.NewReader(f)
+
+	// Detect the format by its magic bytes, or by the extension if none matches
+	var detected *format
+	for _, c := range formats {
+		magic, _ := buffered.Peek(len(c.magic))
+		if bytes.Equal(magic, c.magic) {
+			detected = c
+			break
+		}
+	}
+	if detected == nil {
+		ext := strings.ToLower(filepath.Ext(path))
+		for _, c := range formats {
+			if ext == c.extension {
+				detected = c
+				break
+			}
+		}
+	}
+	if detected == nil {
+		return &reader{Reader: buffered, file: f}, nil
+	}
+
+	r, err := detected.reader(buffered)
+	if err != nil {
+		if f != os.Stdin {
+			f.Close()
+		}
+		return nil, err
+	}
+	return &reader{Reader: r, decompressor: r, file: f}, nil
+}
+
+// Read a whole input file, which is decompressed if it is compressed
+func ReadFile(path string) ([]byte, error) {
+	r, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Return the target path of an output derived from an input file, without the extension of compression
+// of the input, and with the extension of the format of compression of the output if it is compressed
+// Stdout is returned as it is
+func Target(path string, compression string) string {
+	if path == Stdio {
+		return path
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, c := range formats {
+		if ext == c.extension {
+			path = path[:len(path)-len(ext)]
+			break
+		}
+	}
+	if c, _ := output(compression); c != nil {
+		path += c.extension
+	}
+	return path
+}
+
+// File struct writes an output file, which is compressed if asked
+// Writes are safe for concurrent use, and each of them is written as a whole
+type File struct {
+	name       string
+	file       *os.File
+	compressor io.WriteCloser
+
+	// Lock for writing a record at a time
+	lock sync.Mutex
+}
+
+// Create or truncate an output file at the path, or write to stdout if the path is -
+// The output is compressed in the format unless it is empty
+func Create(path string, compression string) (*File, error) {
+	c, err := output(compression)
+	if err != nil {
+		return nil, err
+	}
+	f := os.Stdout
+	if path != Stdio {
+		f, err = os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	file := &File{name: path, file: f}
+	if c != nil {
+		file.compressor, err = c.writer(f)
+		if err != nil {
+			if f != os.Stdout {
+				f.Close()
+			}
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// Write the bytes to the output file
+func (f *File) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.compressor != nil {
+		return f.compressor.Write(p)
+	}
+	return f.file.Write(p)
+}
+
+// Return the path of the output file
+func (f *File) Name() string {
+	return f.name
+}
+
+// Finish the compressed stream if the output is compressed, and close the output file unless it is stdout
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var err error
+	if f.compressor != nil {
+		err = f.compressor.Close()
+	}
+	if f.file == os.Stdout {
+		return err
+	}
+	closeErr := f.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Write a whole output file, which is compressed in the format unless it is empty
+func WriteFile(path string, data []byte, compression string) error {
+	f, err := Create(path, compression)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,209 @@
+/*
+This package evaluates conditions on parsed JSON records.
+It is shared by json_select, which sorts records by conditions, and json_replace,
+which applies a rule only to records meeting the conditions in its when block.
+
+A condition selects values by its key, which is a path in the syntax of package json_path,
+and is met if any selected string, or any string element of a selected array, passes the test.
+
+Types:
+
+	match
+		The value is equal to one of the values.
+
+	prefix
+		The value starts with one of the values.
+
+	suffix
+		The value ends with one of the values.
+
+	regex
+		The value matches one of the regex patterns. Invalid patterns never match.
+
+	exist
+		The key selects any value.
+
+If exclude is true, the condition is met if the test fails instead.
+*/
+package json_condition
+
+import (
+	"errors"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"github.com/Joker-Jane/JSON-replacement/json_path"
+	"regexp"
+	"strings"
+)
+
+// Condition struct represents a condition object
+type Condition struct {
+	Type    string   `json:"type"`
+	Key     string   `json:"key"`
+	Values  []string `json:"values"`
+	Exclude bool     `json:"exclude"`
+
+	// Parsed key
+	path *json_path.Path
+
+	// Compiled patterns of regex conditions, nil if the pattern is invalid
+	patterns []*regexp.Regexp
+}
+
+// Check the condition, parse its key and compile its patterns
+func (c *Condition) Prepare() error {
+	switch c.Type {
+	case "match", "prefix", "suffix", "exist":
+	case "regex":
+		c.patterns = make([]*regexp.Regexp, len(c.Values))
+		for i, value := range c.Values {
+			// Parsing error is ignored and the pattern never matches
+			c.patterns[i], _ = regexp.Compile(value)
+		}
+	default:
+		return errors.New("Invalid condition type '" + c.Type + "'")
+	}
+
+	var err error
+	c.path, err = json_path.Parse(c.Key)
+	return err
+}
+
+// Validate the conditions at the JSON pointer of a rule file, and report every problem
+// Unlike Prepare, invalid regex patterns and conditions that never match are reported
+func Validate(pointer string, v interface{}, e *json_error.ValidationError) {
+	if v == nil {
+		return
+	}
+	conditions, ok := v.([]interface{})
+	if !ok {
+		e.Add(pointer, "Conditions must be an array of condition objects")
+		return
+	}
+
+	for i, raw := range conditions {
+		p := json_error.Pointer(pointer, i)
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			e.Add(p, "Condition must be an object")
+			continue
+		}
+		c := &Condition{}
+		if !e.CheckFields(p, object, c) {
+			continue
+		}
+
+		switch c.Type {
+		case "":
+			e.Add(json_error.Pointer(p, "type"), "Missing type")
+		case "match", "prefix", "suffix", "regex":
+			if len(c.Values) == 0 && !c.Exclude {
+				e.Add(json_error.Pointer(p, "values"), "Condition of type '"+c.Type+"' never matches without values")
+			}
+		case "exist":
+		default:
+			e.Add(json_error.Pointer(p, "type"), "Invalid condition type '"+c.Type+"'")
+		}
+		if c.Type == "regex" {
+			for j, value := range c.Values {
+				_, err := regexp.Compile(value)
+				if err != nil {
+					e.Add(json_error.Pointer(json_error.Pointer(p, "values"), j), "Invalid regex pattern '"+value+"'")
+				}
+			}
+		}
+
+		_, err := json_path.Parse(c.Key)
+		if err != nil {
+			e.Add(json_error.Pointer(p, "key"), err.Error())
+		}
+	}
+}
+
+// Return if all conditions are met
+func MatchAll(conditions []*Condition, v interface{}) bool {
+	return MatchAllAt(conditions, nil, v)
+}
+
+// Same as MatchAll, but the value is located at the prefix of keys and indices in the record
+func MatchAllAt(conditions []*Condition, prefix []interface{}, v interface{}) bool {
+	return MatchAllWithin(conditions, nil, prefix, v)
+}
+
+// Same as MatchAllAt, but values outside the prefix are also selected from the rest of the record,
+// which holds the record without the value
+func MatchAllWithin(conditions []*Condition, record interface{}, prefix []interface{}, v interface{}) bool {
+	for _, c := range conditions {
+		if !c.MatchWithin(record, prefix, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return if the condition is met
+func (c *Condition) Match(v interface{}) bool {
+	return c.MatchAt(nil, v)
+}
+
+// Same as Match, but the value is located at the prefix of keys and indices in the record
+func (c *Condition) MatchAt(prefix []interface{}, v interface{}) bool {
+	return c.MatchWithin(nil, prefix, v)
+}
+
+// Same as MatchAt, but values outside the prefix are also selected from the rest of the record
+func (c *Condition) MatchWithin(record interface{}, prefix []interface{}, v interface{}) bool {
+	return c.process(record, prefix, v) != c.Exclude
+}
+
+// Return if any value selected by the key of the condition passes the test
+// Every string element of a selected array is tested
+func (c *Condition) process(record interface{}, prefix []interface{}, v interface{}) bool {
+	found := c.path.FindAt(prefix, v)
+	if record != nil {
+		found = append(found, c.path.Find(record)...)
+	}
+	for _, found := range found {
+		if c.Type == "exist" {
+			return true
+		}
+		switch found.(type) {
+		case string:
+			if c.test(found.(string)) {
+				return true
+			}
+		case []interface{}:
+			for _, e := range found.([]interface{}) {
+				s, ok := e.(string)
+				if ok && c.test(s) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Test if the field matches the condition
+func (c *Condition) test(v string) bool {
+	for i, value := range c.Values {
+		switch c.Type {
+		case "match":
+			if v == value {
+				return true
+			}
+		case "prefix":
+			if strings.HasPrefix(v, value) {
+				return true
+			}
+		case "suffix":
+			if strings.HasSuffix(v, value) {
+				return true
+			}
+		case "regex":
+			if c.patterns[i] != nil && c.patterns[i].MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+/*
+This package defines the errors returned by json_replace, json_select and json_flat,
+and the policy of handling records that are not in valid JSON format.
+
+Errors:
+
+	ConfigError
+		An argument is missing or a setting is invalid.
+
+	RuleError
+		A rule file or a rule is invalid.
+
+	JSONError
+		A record is not in valid JSON format. If the whole file is a single record, its line is the line
+		of the syntax error in the file, or 0 if the error has no offset.
+
+	IOError
+		A file or directory cannot be read or written.
+
+	ValidationError
+		Validation finds problems in the arguments or the rule file. Every problem is reported,
+		located by the flag of the argument or by a JSON pointer into the rule file.
+
+Policies:
+
+	fail
+		Stop at the first invalid record and return its error. This is the default.
+
+	skip
+		Skip invalid records and continue.
+
+	quarantine
+		Skip invalid records, and write each of them with the reason to a dead-letter file,
+		one JSON object per line.
+*/
+package json_error
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// ConfigError is returned when an argument is missing or a setting is invalid
+type ConfigError struct {
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Message
+}
+
+// RuleError is returned when a rule file or a rule is invalid
+// Rule is the order or position of the invalid rule, or 0 if the whole rule file is invalid
+type RuleError struct {
+	Rule    int
+	Message string
+}
+
+func (e *RuleError) Error() string {
+	return e.Message
+}
+
+// JSONError is returned when a record is not in valid JSON format
+// Line is the line of the record, or of the syntax error if the whole file is a single record,
+// which is 0 if the error has no offset
+type JSONError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *JSONError) Error() string {
+	if e.Line > 0 {
+		return "Error: Line " + strconv.Itoa(e.Line) + " of '" + e.File + "' is not in valid JSON format"
+	}
+	return "Error: File '" + e.File + "' is not in valid JSON format"
+}
+
+func (e *JSONError) Unwrap() error {
+	return e.Err
+}
+
+// Return the line of the syntax or type error of decoding the input, counted from 1,
+// or 0 if the error has no offset
+func Line(input io.Reader, err error) int {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var offset int64
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return 0
+	}
+
+	// Count the line breaks before the offset without reading the whole input at once
+	line := 1
+	reader := bufio.NewReader(io.LimitReader(input, offset))
+	buffer := make([]byte, 32*1024)
+	for {
+		n, readErr := reader.Read(buffer)
+		line += bytes.Count(buffer[:n], []byte("\n"))
+		if readErr != nil {
+			return line
+		}
+	}
+}
+
+// IOError is returned when a file or directory cannot be read or written
+type IOError struct {
+	Path    string
+	Message string
+	Err     error
+}
+
+func (e *IOError) Error() string {
+	return e.Message
+}
+
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+// Policy of handling records that are not in valid JSON format
+type Policy string
+
+const (
+	FailFast   Policy = "fail"
+	Skip       Policy = "skip"
+	Quarantine Policy = "quarantine"
+)
+
+// Handler applies a policy to invalid records, it is shared between routines
+type Handler struct {
+	policy Policy
+
+	// Path to the dead-letter file, which is created when the first record is quarantined
+	deadLetterPath string
+	deadLetter     *os.File
+
+	// Skipped or quarantined records
+	skipped int
+
+	// Lock for updating the counter and writing to the dead-letter file
+	lock sync.Mutex
+}
+
+// Entry struct represents a quarantined record in the dead-letter file
+type Entry struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+	Record string `json:"record"`
+}
+
+// Create a handler, an empty policy fails fast
+func NewHandler(policy Policy, deadLetterPath string) (*Handler, error) {
+	switch policy {
+	case "":
+		policy = FailFast
+	case FailFast, Skip:
+	case Quarantine:
+		if deadLetterPath == "" {
+			return nil, &ConfigError{Message: "Error: Quarantine policy must specify a dead-letter file"}
+		}
+	default:
+		return nil, &ConfigError{Message: "Error: Invalid error policy '" + string(policy) + "'"}
+	}
+	return &Handler{policy: policy, deadLetterPath: deadLetterPath}, nil
+}
+
+// Handle an invalid record
+// Return the error if the policy fails fast, or nil if the record is skipped
+func (h *Handler) Handle(err *JSONError, record []byte) error {
+	if h.policy == FailFast {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.skipped++
+	if h.policy != Quarantine {
+		return nil
+	}
+
+	// Create the dead-letter file at the first quarantined record
+	if h.deadLetter == nil {
+		f, createErr := os.Create(h.deadLetterPath)
+		if createErr != nil {
+			return &IOError{Path: h.deadLetterPath, Message: "Error: Failed to create file '" + h.deadLetterPath + "'", Err: createErr}
+		}
+		h.deadLetter = f
+	}
+
+	reason := err.Error()
+	if err.Err != nil {
+		reason = err.Err.Error()
+	}
+	entry, _ := json.Marshal(Entry{File: err.File, Line: err.Line, Reason: reason, Record: string(record)})
+	_, writeErr := h.deadLetter.Write(append(entry, '\n'))
+	if writeErr != nil {
+		return &IOError{Path: h.deadLetterPath, Message: "Error: Cannot write to '" + h.deadLetterPath + "'", Err: writeErr}
+	}
+	return nil
+}
+
+// Return the number of skipped or quarantined records
+func (h *Handler) Skipped() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.skipped
+}
+
+// Close the dead-letter file if it is created
+func (h *Handler) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.deadLetter == nil {
+		return nil
+	}
+	err := h.deadLetter.Close()
+	h.deadLetter = nil
+	if err != nil {
+		return &IOError{Path: h.deadLetterPath, Message: "Error: Failed to close file '" + h.deadLetterPath + "'", Err: err}
+	}
+	return nil
+}
+
+// First records the first error returned by routines, it is shared between routines
+type First struct {
+	err  error
+	lock sync.Mutex
+}
+
+// Record an error if it is the first one
+func (f *First) Set(err error) {
+	if err == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+// Return the first error recorded
+func (f *First) Get() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.err
+}
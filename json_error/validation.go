@@ -0,0 +1,243 @@
+package json_error
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Problem is a single problem found by validation
+// It is located by the flag of an argument, or by a JSON pointer into the rule file if Flag is empty
+type Problem struct {
+	Flag    string
+	Pointer string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Flag != "" {
+		return p.Flag + ": " + p.Message
+	}
+	return strconv.Quote(p.Pointer) + ": " + p.Message
+}
+
+// ValidationError is returned when validation finds problems in the arguments or the rule file
+// Every problem is reported instead of the first one
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString("Error: Found " + strconv.Itoa(len(e.Problems)) + " problem(s)")
+	for _, p := range e.Problems {
+		b.WriteString("\n\t" + p.String())
+	}
+	return b.String()
+}
+
+// Report a problem in the rule file at the JSON pointer
+func (e *ValidationError) Add(pointer string, message string) {
+	e.Problems = append(e.Problems, Problem{Pointer: pointer, Message: message})
+}
+
+// Report a problem of the argument of the flag
+func (e *ValidationError) AddFlag(flag string, message string) {
+	e.Problems = append(e.Problems, Problem{Flag: flag, Message: message})
+}
+
+// Report the error of a constructor or a handler as a problem of the argument of the flag
+func (e *ValidationError) AddFlagError(flag string, err error) {
+	e.AddFlag(flag, strings.TrimPrefix(err.Error(), "Error: "))
+}
+
+// Return the error if any problem is found, or nil otherwise
+func (e *ValidationError) Err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Return the JSON pointer to a key of an object or an index of an array under the parent pointer
+func Pointer(parent string, token interface{}) string {
+	switch token := token.(type) {
+	case int:
+		return parent + "/" + strconv.Itoa(token)
+	case string:
+		token = strings.ReplaceAll(token, "~", "~0")
+		return parent + "/" + strings.ReplaceAll(token, "/", "~1")
+	}
+	return parent
+}
+
+// Parse a rule file into generic values, numbers are kept as json.Number so that they can be decoded again
+// Return false after reporting the problem if the rule file is not an array
+func ParseRules(content []byte, e *ValidationError) ([]interface{}, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var v interface{}
+	err := decoder.Decode(&v)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			e.Add("", "Rule file is not in valid JSON format at offset "+strconv.FormatInt(syntaxErr.Offset, 10)+": "+err.Error())
+		} else {
+			e.Add("", "Rule file is not in valid JSON format: "+err.Error())
+		}
+		return nil, false
+	}
+	rules, ok := v.([]interface{})
+	if !ok {
+		e.Add("", "Rule file must be an array of rule objects")
+		return nil, false
+	}
+	return rules, true
+}
+
+// Check the members of a JSON object against the json tags of the struct pointed to by target,
+// and report every unknown member and every member of a wrong type
+// Members listed in nested are validated by the caller and are only checked to be known
+// Return true after decoding the object into target if every member is of the right type
+func (e *ValidationError) CheckFields(pointer string, object map[string]interface{}, target interface{}, nested ...string) bool {
+	t := reflect.TypeOf(target).Elem()
+	known := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+
+	var keys []string
+	for k := range object {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ok := true
+	for _, k := range keys {
+		if !known[k] {
+			e.Add(Pointer(pointer, k), "Unknown field '"+k+"'")
+			continue
+		}
+		if contains(nested, k) {
+			continue
+		}
+
+		// Decode the member alone to find if it is of a wrong type
+		member, _ := json.Marshal(map[string]interface{}{k: object[k]})
+		err := json.Unmarshal(member, reflect.New(t).Interface())
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			e.Add(Pointer(pointer, k), "Field '"+k+"' must be "+kindOf(typeErr.Type))
+			ok = false
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	rest := map[string]interface{}{}
+	for k, v := range object {
+		if !contains(nested, k) {
+			rest[k] = v
+		}
+	}
+	content, _ := json.Marshal(rest)
+	return json.Unmarshal(content, target) == nil
+}
+
+// Return the JSON kind of values decoded into the type
+func kindOf(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Pointer:
+		return kindOf(t.Elem())
+	}
+	return "a valid value"
+}
+
+// Return if the list contains the string
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Report if the output path of the flag cannot be created, which is when a parent of it is a file
+// If dir is true, the output path must also not be an existing file
+func (e *ValidationError) CheckOutput(flag string, path string, dir bool) {
+	if path == "" {
+		e.AddFlag(flag, "Output path must be specified")
+		return
+	}
+	info, err := os.Stat(path)
+	if err == nil {
+		if dir && !info.IsDir() {
+			e.AddFlag(flag, "Output path '"+path+"' must be a directory")
+		}
+		return
+	}
+
+	// Find the nearest existing parent, which must be a directory
+	for parent := filepath.Dir(path); ; parent = filepath.Dir(parent) {
+		info, err = os.Stat(parent)
+		if err == nil {
+			if !info.IsDir() {
+				e.AddFlag(flag, "Output path '"+path+"' is unreachable, since '"+parent+"' is not a directory")
+			}
+			return
+		}
+		if parent == filepath.Dir(parent) {
+			return
+		}
+	}
+}
+
+// Report if the input path of the flag does not exist
+func (e *ValidationError) CheckInput(flag string, path string) {
+	if path == "" {
+		e.AddFlag(flag, "Input path must be specified")
+		return
+	}
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		e.AddFlag(flag, "Input path '"+path+"' not found")
+	} else if err != nil {
+		e.AddFlag(flag, "Cannot read input path '"+path+"'")
+	}
+}
+
+// Report if the error policy of the -e flag, or its dead-letter file of the -d flag, is invalid
+func (e *ValidationError) CheckPolicy(policy Policy, deadLetterPath string) {
+	_, err := NewHandler(policy, deadLetterPath)
+	if err != nil {
+		e.AddFlagError("-e", err)
+		return
+	}
+	if policy == Quarantine {
+		e.CheckOutput("-d", deadLetterPath, false)
+	}
+}
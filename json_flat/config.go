@@ -2,12 +2,24 @@ package json_flat
 
 import (
 	"flag"
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
 	"path/filepath"
 )
 
 type Config struct {
 	inputPath  string
 	outputPath string
+
+	// Format of compression of output files, which is empty if they are not compressed
+	compress string
+
+	// Whether the arguments are only checked
+	validate bool
+
+	// Policy of handling invalid records, and the path to the dead-letter file of quarantined records
+	errorPolicy    json_error.Policy
+	deadLetterPath string
 }
 
 func NewConfig(inputPath string, outputPath string) *Config {
@@ -26,12 +38,38 @@ func NewDefaultConfig(inputPath string, outputPath string) *Config {
 	return NewConfig(inputPath, outputPath)
 }
 
+// Set the format of compression of output files, gzip or zstd, or disable it with an empty format
+func (c *Config) SetCompress(compression string) {
+	c.compress = compression
+}
+
+// Enable or disable validate mode, which only checks the arguments and reports every problem
+func (c *Config) SetValidate(validate bool) {
+	c.validate = validate
+}
+
+// Set the policy of handling records not in valid JSON format, which is fail, skip or quarantine
+// Quarantined records are written with the reason to the dead-letter file
+func (c *Config) SetErrorPolicy(policy json_error.Policy, deadLetterPath string) {
+	c.errorPolicy = policy
+	c.deadLetterPath = deadLetterPath
+}
+
 func NewConfigFromConsole() *Config {
 	// Config and parse flags
 	inputPath := flag.String("i", "", "input path")
 	outputPath := flag.String("o", "", "output path")
+	validate := flag.Bool("c", false, "validate the arguments")
+	errorPolicy := flag.String("e", "fail", "error policy of fail, skip or quarantine")
+	deadLetterPath := flag.String("d", "", "dead-letter path")
+	var compression json_compress.Compression
+	flag.Var(&compression, "g", "compress outputs by gzip, or by the format of -g=format")
 
 	flag.Parse()
 
-	return NewConfig(*inputPath, *outputPath)
+	c := NewConfig(*inputPath, *outputPath)
+	c.compress = string(compression)
+	c.validate = *validate
+	c.SetErrorPolicy(json_error.Policy(*errorPolicy), *deadLetterPath)
+	return c
 }
@@ -2,6 +2,10 @@
 This program reads file(s) containing compressed JSON records with dots in keys, and flat these
 records to output file(s) in the form of original records.
 
+Input files compressed by gzip, bzip2 or zstd are decompressed while they are read, as done by package json_compress.
+The input path - reads records from stdin, and the output path - writes records to stdout,
+so that the program can be a part of a pipeline.
+
 Usage:
 
 ./json_flat [flags]
@@ -9,10 +13,27 @@ Usage:
 Flags:
 
 	-i input_path
-		Set the path to the input file or directory.
+		Set the path to the input file or directory, or - for stdin.
 
 	-o output_path
-		Set the path to the output directory.
+		Set the path to the output directory, or - for stdout.
+
+	-c
+		Check the arguments without processing anything, and report every problem.
+
+	-e policy
+		Set the policy of handling records not in valid JSON format. Default: fail
+		fail stops at the first invalid record, skip skips invalid records,
+		and quarantine also writes each of them with the reason to the dead-letter file.
+
+	-d dead_letter_path
+		Set the path to the dead-letter file of quarantined records.
+
+	-g[=format]
+		Compress output files by gzip, or by the format gzip or zstd given as -g=zstd. Default: false
+		The extension .gz, .bz2 or .zst of compressed input files is removed from output files
+		in the output directory, and .gz or .zst is appended to them if they are compressed.
+		An output file given explicitly is written to the path as it is.
 */
 
 package json_flat
@@ -22,11 +43,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -34,71 +56,142 @@ import (
 type JSONFlat struct {
 	// Configs
 	config *Config
+
+	// Handler of invalid records by the error policy
+	errors *json_error.Handler
 }
 
-func NewJSONFlat(config *Config) *JSONFlat {
+func NewJSONFlat(config *Config) (*JSONFlat, error) {
+	// Only check the arguments in validate mode
+	if config.validate {
+		err := Validate(config)
+		if err != nil {
+			return nil, err
+		}
+		return &JSONFlat{config: config}, nil
+	}
+
 	// Check if all arguments are specified
 	if config.inputPath == "" || config.outputPath == "" {
-		log.Fatal("Usage: ./json_select -i input -o output")
+		return nil, &json_error.ConfigError{Message: "Usage: ./json_select -i input -o output"}
 	}
 
-	// Check if input path exists
-	_, err := os.Stat(config.inputPath)
-	if err != nil {
+	// Check if outputs can be compressed in the format
+	if err := json_compress.Check(config.compress); err != nil {
+		return nil, &json_error.ConfigError{Message: "Error: " + err.Error()}
+	}
+
+	// Check if input path exists, stdin always exists
+	if config.inputPath != json_compress.Stdio {
+		_, err := os.Stat(config.inputPath)
 		if errors.Is(err, os.ErrNotExist) {
-			log.Fatal("Error: Input path '" + config.inputPath + "' not found")
-		} else {
-			log.Fatal("Error: Cannot read input path '" + config.inputPath + "'")
+			return nil, &json_error.IOError{Path: config.inputPath, Message: "Error: Input path '" + config.inputPath + "' not found", Err: err}
+		} else if err != nil {
+			return nil, &json_error.IOError{Path: config.inputPath, Message: "Error: Cannot read input path '" + config.inputPath + "'", Err: err}
 		}
 	}
 
+	handler, err := json_error.NewHandler(config.errorPolicy, config.deadLetterPath)
+	if err != nil {
+		return nil, err
+	}
+
 	// Construct JSONSelect object
 	flat := &JSONFlat{
 		config: config,
+		errors: handler,
 	}
 
-	return flat
+	return flat, nil
 }
 
-func (flat *JSONFlat) Exec() {
+// Return the first error, records not in valid JSON format are handled by the error policy
+func (flat *JSONFlat) Exec() error {
+	// Nothing is processed in validate mode
+	if flat.config.validate {
+		log.Printf("Success: Arguments are valid\n")
+		return nil
+	}
+
 	// Record start time
 	startTime := time.Now()
 
 	// Record count
 	count := 0
 
-	// Walk through and process the input file tree
-	err := filepath.WalkDir(flat.config.inputPath, func(path string, d fs.DirEntry, err error) error {
-		if !d.IsDir() {
-			flat.handleFile(path)
-			count++
-		}
-		return err
-	})
+	// Process stdin as a single file, or walk through and process the input file tree
+	var err error
+	if flat.config.inputPath == json_compress.Stdio {
+		count++
+		err = flat.handleFile(json_compress.Stdio)
+	} else {
+		err = filepath.WalkDir(flat.config.inputPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return &json_error.IOError{Path: flat.config.inputPath, Message: "Error: Failed to walk through the input directory", Err: err}
+			}
+			if !d.IsDir() {
+				count++
+				return flat.handleFile(path)
+			}
+			return nil
+		})
+	}
+	closeErr := flat.errors.Close()
 	if err != nil {
-		log.Fatal("Error: Failed to walk through the input directory")
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
 	}
 
 	// Log output
-	log.Printf("Success: Processed %d file(s) in %.4f second(s)\n",
-		count, time.Since(startTime).Seconds())
+	log.Printf("Success: Processed %d file(s) and skipped %d invalid record(s) in %.4f second(s)\n",
+		count, flat.errors.Skipped(), time.Since(startTime).Seconds())
+	return nil
+}
+
+// Check the arguments without processing anything
+// Return a ValidationError reporting every problem, or nil if there is none
+func Validate(config *Config) error {
+	e := &json_error.ValidationError{}
+	if config.inputPath != json_compress.Stdio {
+		e.CheckInput("-i", config.inputPath)
+	}
+	if config.outputPath != json_compress.Stdio {
+		e.CheckOutput("-o", config.outputPath, false)
+	}
+	e.CheckPolicy(config.errorPolicy, config.deadLetterPath)
+	if err := json_compress.Check(config.compress); err != nil {
+		e.AddFlagError("-g", err)
+	}
+	return e.Err()
 }
 
-func (flat *JSONFlat) handleFile(filePath string) {
+func (flat *JSONFlat) handleFile(filePath string) error {
 	// Open the input file
-	f, err := os.Open(filePath)
-	defer f.Close()
+	f, err := json_compress.Open(filePath)
 	if err != nil {
-		log.Fatal("Error: Cannot read input file '" + filePath + "'")
+		return &json_error.IOError{Path: filePath, Message: "Error: Cannot read input file '" + filePath + "'", Err: err}
 	}
+	defer f.Close()
 
 	scanner := bufio.NewScanner(f)
 
 	// Record line number
 	line := 0
 
-	// Get target output path
-	target := strings.Replace(filePath, flat.config.inputPath, flat.config.outputPath, 1)
+	// Get target output path, an output file given explicitly is written as it is, and an output derived
+	// from a file in the input directory takes the extension of compression if outputs are compressed
+	target := flat.config.outputPath
+	if filePath != flat.config.inputPath {
+		target = strings.Replace(filePath, flat.config.inputPath, flat.config.outputPath, 1)
+		target = json_compress.Target(target, flat.config.compress)
+	}
+
+	// Every file is written to stdout if the output path is -
+	if flat.config.outputPath == json_compress.Stdio {
+		target = json_compress.Stdio
+	}
 
 	// Get parent directory of the target
 	dir, _ := filepath.Split(target)
@@ -107,16 +200,16 @@ func (flat *JSONFlat) handleFile(filePath string) {
 	if dir != "" {
 		err = os.MkdirAll(dir, 0700)
 		if err != nil {
-			log.Fatal("Error: Failed to create directory '" + dir + "'")
+			return &json_error.IOError{Path: dir, Message: "Error: Failed to create directory '" + dir + "'", Err: err}
 		}
 	}
 
 	// Open or create the file
-	outputFile, err := os.Create(target)
-	defer outputFile.Close()
+	outputFile, err := json_compress.Create(target, flat.config.compress)
 	if err != nil {
-		log.Fatal("Error: Failed to open or create file '" + target + "'")
+		return &json_error.IOError{Path: target, Message: "Error: Failed to open or create file '" + target + "'", Err: err}
 	}
+	defer outputFile.Close()
 
 	// Scan the input file line by line
 	for scanner.Scan() {
@@ -130,32 +223,45 @@ func (flat *JSONFlat) handleFile(filePath string) {
 		bytes := make([]byte, len(scanner.Bytes()))
 		copy(bytes, scanner.Bytes())
 
-		// Handle the line and get result
-		result := flat.handleJSON(&bytes, filePath, line)
+		// Handle the line and get result, skip the line unless the error policy fails fast
+		result, err := flat.handleJSON(&bytes)
+		if err != nil {
+			err = flat.errors.Handle(&json_error.JSONError{File: filePath, Line: line, Err: err}, bytes)
+			if err != nil {
+				return err
+			}
+			continue
+		}
 
 		// Write to target file
 		_, err = fmt.Fprintln(outputFile, string(result))
 
 		if err != nil {
-			log.Fatal("Error: Cannot write to '" + target + "'")
+			return &json_error.IOError{Path: target, Message: "Error: Cannot write to '" + target + "'", Err: err}
 		}
 	}
+	if err = scanner.Err(); err != nil {
+		return &json_error.IOError{Path: filePath, Message: "Error: Cannot read input file '" + filePath + "'", Err: err}
+	}
+
+	// Closing a compressed output file writes the end of its compressed stream
+	err = outputFile.Close()
+	if err != nil {
+		return &json_error.IOError{Path: target, Message: "Error: Cannot write to '" + target + "'", Err: err}
+	}
+	return nil
 }
 
-func (flat *JSONFlat) handleJSON(input *[]byte, filePath string, line int) []byte {
+func (flat *JSONFlat) handleJSON(input *[]byte) ([]byte, error) {
 	// Parse input json
 	var v map[string]interface{}
 	err := json.Unmarshal(*input, &v)
 	if err != nil {
-		if errors.Is(&json.SyntaxError{}, err) {
-			log.Fatal("Error: Line " + strconv.Itoa(line) + " of '" + filePath + "' is not in valid JSON format")
-		} else {
-			log.Fatal(err)
-		}
+		return nil, err
 	}
 
 	output, _ := json.Marshal(flat.flat(v))
-	return output
+	return output, nil
 }
 
 func (flat *JSONFlat) flat(input map[string]interface{}) map[string]interface{} {
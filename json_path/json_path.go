@@ -0,0 +1,532 @@
+/*
+This package parses field paths and selects values of parsed JSON records by them.
+It is shared by json_replace and json_select so that both use the same selector language.
+
+A path is a list of segments separated by dots:
+
+	key
+		Select the field with the name. Applied to an array, it selects the field of every element.
+
+	"key.with.dots" or 'key.with.dots' or key\.with\.dots
+		Select the field whose name contains special characters.
+
+	*
+		Select every field of a map, or every element of an array.
+
+	**
+		Select the current value and every value below it, at any depth.
+
+	[n]
+		Select the n-th element of an array. Negative indices count from the end.
+
+	[start:end]
+		Select the elements from start up to but excluding end. Both bounds are optional.
+
+	[*]
+		Select every element of an array.
+
+	["key.with.dots"]
+		Select the field whose name contains special characters.
+
+Brackets may follow a segment directly, such as events[0].user or **.tokens[-1].
+*/
+package json_path
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of segments
+const (
+	keySegment = iota
+	wildcardSegment
+	recursiveSegment
+	indexSegment
+	sliceSegment
+)
+
+// Path struct represents a parsed path
+type Path struct {
+	raw      string
+	segments []*segment
+}
+
+// segment struct represents a single segment of a path
+type segment struct {
+	kind  int
+	key   string
+	index int
+	start *int
+	end   *int
+}
+
+// deletion type marks a value to be deleted from its parent
+type deletion struct{}
+
+// Delete is returned by the function of Apply to delete the value from its parent
+var Delete interface{} = deletion{}
+
+// Parse a path
+func Parse(path string) (*Path, error) {
+	p := &Path{raw: path}
+	if path == "" {
+		return nil, errors.New("Path must not be empty")
+	}
+
+	i := 0
+	for i < len(path) {
+		// A dot separates two segments, and must be followed by a segment
+		if i > 0 && path[i] != '[' {
+			if path[i] != '.' {
+				return nil, errors.New("Unexpected character at position " + strconv.Itoa(i) + " of path '" + path + "'")
+			}
+			i++
+			if i == len(path) {
+				return nil, errors.New("Path '" + path + "' must not end with a dot")
+			}
+		}
+
+		var seg *segment
+		var err error
+		switch path[i] {
+		case '[':
+			seg, i, err = parseBracket(path, i)
+		case '"', '\'':
+			var key string
+			key, i, err = parseQuoted(path, i)
+			seg = &segment{kind: keySegment, key: key}
+		default:
+			seg, i, err = parsePlain(path, i)
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.segments = append(p.segments, seg)
+	}
+	return p, nil
+}
+
+// Parse a plain segment starting at i, return the segment and the position after it
+func parsePlain(path string, i int) (*segment, int, error) {
+	var key strings.Builder
+	escaped := false
+	start := i
+	for ; i < len(path); i++ {
+		c := path[i]
+		if c == '\\' {
+			if i+1 == len(path) {
+				return nil, i, errors.New("Path '" + path + "' must not end with a backslash")
+			}
+			i++
+			key.WriteByte(path[i])
+			escaped = true
+			continue
+		}
+		if c == '.' || c == '[' {
+			break
+		}
+		key.WriteByte(c)
+	}
+	if i == start {
+		return nil, i, errors.New("Empty segment at position " + strconv.Itoa(i) + " of path '" + path + "'")
+	}
+
+	// Escaped asterisks are plain keys
+	if !escaped {
+		switch key.String() {
+		case "*":
+			return &segment{kind: wildcardSegment}, i, nil
+		case "**":
+			return &segment{kind: recursiveSegment}, i, nil
+		}
+	}
+	return &segment{kind: keySegment, key: key.String()}, i, nil
+}
+
+// Parse a quoted key starting at i, return the key and the position after the closing quote
+func parseQuoted(path string, i int) (string, int, error) {
+	quote := path[i]
+	var key strings.Builder
+	for i++; i < len(path); i++ {
+		c := path[i]
+		if c == '\\' && i+1 < len(path) {
+			i++
+			key.WriteByte(path[i])
+			continue
+		}
+		if c == quote {
+			return key.String(), i + 1, nil
+		}
+		key.WriteByte(c)
+	}
+	return "", i, errors.New("Unterminated quote in path '" + path + "'")
+}
+
+// Parse a bracket segment starting at i, return the segment and the position after the closing bracket
+func parseBracket(path string, i int) (*segment, int, error) {
+	i++
+	if i < len(path) && (path[i] == '"' || path[i] == '\'') {
+		key, next, err := parseQuoted(path, i)
+		if err != nil {
+			return nil, next, err
+		}
+		if next >= len(path) || path[next] != ']' {
+			return nil, next, errors.New("Unterminated bracket in path '" + path + "'")
+		}
+		return &segment{kind: keySegment, key: key}, next + 1, nil
+	}
+
+	end := strings.IndexByte(path[i:], ']')
+	if end < 0 {
+		return nil, i, errors.New("Unterminated bracket in path '" + path + "'")
+	}
+	content := strings.TrimSpace(path[i : i+end])
+	next := i + end + 1
+	invalid := errors.New("Invalid index '" + content + "' in path '" + path + "'")
+
+	if content == "*" {
+		return &segment{kind: wildcardSegment}, next, nil
+	}
+
+	low, high, isSlice := strings.Cut(content, ":")
+	if !isSlice {
+		index, err := strconv.Atoi(content)
+		if err != nil {
+			return nil, next, invalid
+		}
+		return &segment{kind: indexSegment, index: index}, next, nil
+	}
+
+	seg := &segment{kind: sliceSegment}
+	if low = strings.TrimSpace(low); low != "" {
+		start, err := strconv.Atoi(low)
+		if err != nil {
+			return nil, next, invalid
+		}
+		seg.start = &start
+	}
+	if high = strings.TrimSpace(high); high != "" {
+		end, err := strconv.Atoi(high)
+		if err != nil {
+			return nil, next, invalid
+		}
+		seg.end = &end
+	}
+	return seg, next, nil
+}
+
+// Return the path as it is written
+func (p *Path) String() string {
+	return p.raw
+}
+
+// Format the location of a value, which is a list of keys and indices, as a path selecting only the value
+// Keys with special characters are quoted in brackets
+func Format(location []interface{}) string {
+	var b strings.Builder
+	for _, step := range location {
+		switch step := step.(type) {
+		case int:
+			b.WriteString("[" + strconv.Itoa(step) + "]")
+		case string:
+			if step == "" || step == "*" || step == "**" || strings.ContainsAny(step, ".[]\\\"'") {
+				quoted := strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(step)
+				b.WriteString("[\"" + quoted + "\"]")
+				continue
+			}
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(step)
+		}
+	}
+	return b.String()
+}
+
+// Find every value selected by the path
+func (p *Path) Find(v interface{}) []interface{} {
+	return p.FindAt(nil, v)
+}
+
+// Replace every value selected by the path with the result of the function, and return the new value
+// A value is deleted from its parent if the function returns Delete
+func (p *Path) Apply(v interface{}, fn func(interface{}) interface{}) interface{} {
+	return p.ApplyAt(nil, v, fn)
+}
+
+// Same as Apply, but if the last segment is a key missing in a map, the function is called with nil
+// and the result is added to the map
+func (p *Path) Put(v interface{}, fn func(interface{}) interface{}) interface{} {
+	return p.PutAt(nil, v, fn)
+}
+
+// Same as Find, but the value is located at the prefix of keys and indices in the record
+func (p *Path) FindAt(prefix []interface{}, v interface{}) []interface{} {
+	var found []interface{}
+	p.ApplyAt(prefix, v, func(v interface{}) interface{} {
+		found = append(found, v)
+		return v
+	})
+	return found
+}
+
+// Same as Apply, but the value is located at the prefix of keys and indices in the record
+func (p *Path) ApplyAt(prefix []interface{}, v interface{}, fn func(interface{}) interface{}) interface{} {
+	return p.ApplyLocated(prefix, v, func(_ []interface{}, v interface{}) interface{} {
+		return fn(v)
+	})
+}
+
+// Same as Put, but the value is located at the prefix of keys and indices in the record
+func (p *Path) PutAt(prefix []interface{}, v interface{}, fn func(interface{}) interface{}) interface{} {
+	return p.PutLocated(prefix, v, func(_ []interface{}, v interface{}) interface{} {
+		return fn(v)
+	})
+}
+
+// Same as ApplyAt, but the function is also called with the location of every selected value in the record,
+// which starts with the prefix and is only valid during the call
+func (p *Path) ApplyLocated(prefix []interface{}, v interface{}, fn func([]interface{}, interface{}) interface{}) interface{} {
+	return p.located(prefix, v, fn, false)
+}
+
+// Same as PutAt, but the function is also called with the location of every selected value in the record,
+// which starts with the prefix and is only valid during the call
+func (p *Path) PutLocated(prefix []interface{}, v interface{}, fn func([]interface{}, interface{}) interface{}) interface{} {
+	return p.located(prefix, v, fn, true)
+}
+
+// Walk through the value located at the prefix by the segments remaining after the prefix
+func (p *Path) located(prefix []interface{}, v interface{}, fn func([]interface{}, interface{}) interface{}, create bool) interface{} {
+	for _, offset := range p.remaining(prefix) {
+		location := append([]interface{}{}, prefix...)
+		v = walk(v, p.segments[offset:], fn, create, location)
+		if isDelete(v) {
+			break
+		}
+	}
+	return v
+}
+
+// Return the offsets of the segments remaining to be walked after walking through the prefix,
+// where the prefix is a list of string keys and int indices
+// Since the length of the arrays in the prefix is unknown, negative indices never match them
+func (p *Path) remaining(prefix []interface{}) []int {
+	offsets := []int{0}
+	for _, step := range prefix {
+		seen := map[int]bool{}
+		var next []int
+		for _, offset := range offsets {
+			for _, o := range p.advance(offset, step) {
+				if !seen[o] {
+					seen[o] = true
+					next = append(next, o)
+				}
+			}
+		}
+		offsets = next
+	}
+	sort.Ints(offsets)
+	return offsets
+}
+
+// Return the offsets of the segments remaining after walking from the offset through a key or an index
+func (p *Path) advance(offset int, step interface{}) []int {
+	index, isIndex := step.(int)
+
+	// The path selects an array containing the value, which applies on every element
+	if offset == len(p.segments) {
+		if isIndex {
+			return []int{offset}
+		}
+		return nil
+	}
+
+	seg := p.segments[offset]
+	switch seg.kind {
+	case keySegment:
+		// Key segments apply to every element of an array
+		if isIndex {
+			return []int{offset}
+		}
+		if step.(string) == seg.key {
+			return []int{offset + 1}
+		}
+	case wildcardSegment:
+		return []int{offset + 1}
+	case recursiveSegment:
+		// Descend into the value, or select nothing with the recursive segment
+		offsets := []int{offset}
+		last := offset+1 == len(p.segments)
+		if isIndex && (last || p.segments[offset+1].kind == keySegment) {
+			// Same as walk, the array itself is skipped since its elements are visited
+			return offsets
+		}
+		if last {
+			return offsets
+		}
+		return append(offsets, p.advance(offset+1, step)...)
+	case indexSegment:
+		if isIndex && seg.index >= 0 && seg.index == index {
+			return []int{offset + 1}
+		}
+	case sliceSegment:
+		if isIndex &&
+			(seg.start == nil || (*seg.start >= 0 && index >= *seg.start)) &&
+			(seg.end == nil || (*seg.end >= 0 && index < *seg.end)) {
+			return []int{offset + 1}
+		}
+	}
+	return nil
+}
+
+// Walk through the value at the location by the segments and apply the function on every selected value
+// The location is extended in place while walking, so the function must copy it to keep it
+func walk(v interface{}, segs []*segment, fn func([]interface{}, interface{}) interface{}, create bool, location []interface{}) interface{} {
+	if len(segs) == 0 {
+		return fn(location, v)
+	}
+	seg, rest := segs[0], segs[1:]
+
+	switch seg.kind {
+	case keySegment:
+		switch v.(type) {
+		case map[string]interface{}:
+			m := v.(map[string]interface{})
+			child, found := m[seg.key]
+			if found || (create && len(rest) == 0) {
+				set(m, seg.key, walk(child, rest, fn, create, append(location, seg.key)))
+			}
+		case []interface{}:
+			// Key segments apply to every element of an array
+			a := v.([]interface{})
+			return walkElements(a, allIndices(a), segs, fn, create, location)
+		}
+	case wildcardSegment:
+		switch v.(type) {
+		case map[string]interface{}:
+			m := v.(map[string]interface{})
+			for k, child := range m {
+				set(m, k, walk(child, rest, fn, create, append(location, k)))
+			}
+		case []interface{}:
+			a := v.([]interface{})
+			return walkElements(a, allIndices(a), rest, fn, create, location)
+		}
+	case recursiveSegment:
+		// Descend into the children first, so that replaced values are not walked again
+		switch v.(type) {
+		case map[string]interface{}:
+			m := v.(map[string]interface{})
+			for k, child := range m {
+				set(m, k, walk(child, segs, fn, create, append(location, k)))
+			}
+		case []interface{}:
+			a := v.([]interface{})
+			v = walkElements(a, allIndices(a), segs, fn, create, location)
+
+			// Elements are already visited, so key segments are not applied to the array again
+			if len(rest) > 0 && rest[0].kind == keySegment {
+				return v
+			}
+		}
+		return walk(v, rest, fn, create, location)
+	case indexSegment, sliceSegment:
+		a, ok := v.([]interface{})
+		if ok {
+			return walkElements(a, seg.indices(len(a)), rest, fn, create, location)
+		}
+	}
+	return v
+}
+
+// Walk through the elements of the indices in an array, and remove the deleted elements
+// Elements are located by their indices before any of them is removed
+func walkElements(a []interface{}, indices []int, segs []*segment, fn func([]interface{}, interface{}) interface{}, create bool, location []interface{}) interface{} {
+	deleted := false
+	for _, i := range indices {
+		a[i] = walk(a[i], segs, fn, create, append(location, i))
+		if isDelete(a[i]) {
+			deleted = true
+		}
+	}
+	if !deleted {
+		return a
+	}
+
+	kept := make([]interface{}, 0, len(a))
+	for _, e := range a {
+		if !isDelete(e) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// Set a value in a map, or delete the key if the value is Delete
+func set(m map[string]interface{}, k string, v interface{}) {
+	if isDelete(v) {
+		delete(m, k)
+	} else {
+		m[k] = v
+	}
+}
+
+// Return if the value is Delete
+func isDelete(v interface{}) bool {
+	_, ok := v.(deletion)
+	return ok
+}
+
+// Return every index of an array
+func allIndices(a []interface{}) []int {
+	indices := make([]int, len(a))
+	for i := range a {
+		indices[i] = i
+	}
+	return indices
+}
+
+// Return the indices selected by an index or slice segment in an array of the length
+func (seg *segment) indices(length int) []int {
+	if seg.kind == indexSegment {
+		i := seg.index
+		if i < 0 {
+			i += length
+		}
+		if i < 0 || i >= length {
+			return nil
+		}
+		return []int{i}
+	}
+
+	start, end := 0, length
+	if seg.start != nil {
+		start = clamp(*seg.start, length)
+	}
+	if seg.end != nil {
+		end = clamp(*seg.end, length)
+	}
+	var indices []int
+	for i := start; i < end; i++ {
+		indices = append(indices, i)
+	}
+	return indices
+}
+
+// Resolve a negative bound of a slice and clamp it into [0, length]
+func clamp(i int, length int) int {
+	if i < 0 {
+		i += length
+	}
+	if i < 0 {
+		return 0
+	}
+	if i > length {
+		return length
+	}
+	return i
+}
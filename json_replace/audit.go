@@ -0,0 +1,214 @@
+package json_replace
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"github.com/Joker-Jane/JSON-replacement/json_path"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Actions of changes recorded in the audit log
+const (
+	actionReplace = "replace"
+	actionAdd     = "add"
+	actionRemove  = "remove"
+	actionDrop    = "drop"
+)
+
+// Audit struct writes every change made by the rules to the audit log, one JSON object per line
+// Original values are never written, only their hashes salted by the key of the audit log
+type Audit struct {
+	path   string
+	salt   []byte
+	file   *os.File
+	writer *bufio.Writer
+
+	// The first error of writing, which is returned when the audit log is closed
+	err error
+
+	// Lock for writing an entry at a time
+	lock sync.Mutex
+}
+
+// AuditEntry struct represents a single change in the audit log
+// Line is the line of the record in line-by-line mode, and path is the path of the changed value
+// in the syntax of package json_path, which is empty if the whole record is dropped
+// The original hash is the HMAC-SHA256 of the original value by the salt, which is the string itself
+// for strings or the JSON representation otherwise, and is empty for added values
+type AuditEntry struct {
+	File         string `json:"file"`
+	Line         int    `json:"line,omitempty"`
+	Path         string `json:"path"`
+	Rule         int    `json:"rule"`
+	Type         string `json:"type"`
+	Action       string `json:"action"`
+	OriginalHash string `json:"original-hash,omitempty"`
+}
+
+// Create the audit log
+func openAudit(path string, salt string) (*Audit, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, &json_error.IOError{Path: path, Message: "Error: Failed to open or create file '" + path + "'", Err: err}
+	}
+	return &Audit{path: path, salt: []byte(salt), file: f, writer: bufio.NewWriter(f)}, nil
+}
+
+// Record the changes made by a rule on a record, or on an element of the record located at the prefix
+// A dropped record is recorded as a whole with its value
+func (audit *Audit) record(r *Rule, state *fileState, prefix []interface{}, v interface{}, log *changeLog, dropped bool) {
+	var entries []*AuditEntry
+	add := func(location []interface{}, original interface{}, action string) {
+		entry := &AuditEntry{File: state.path, Line: state.line, Path: json_path.Format(location), Rule: r.Order, Type: r.Type, Action: action}
+		if action != actionAdd {
+			entry.OriginalHash = audit.hash(original)
+		}
+		entries = append(entries, entry)
+	}
+
+	if dropped {
+		add(prefix, v, actionDrop)
+	} else {
+		for _, c := range log.changes {
+			add(c.location, c.original, c.action)
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	for _, entry := range entries {
+		line, _ := json.Marshal(entry)
+		_, err := audit.writer.Write(append(line, '\n'))
+		if err != nil && audit.err == nil {
+			audit.err = &json_error.IOError{Path: audit.path, Message: "Error: Cannot write to '" + audit.path + "'", Err: err}
+		}
+	}
+}
+
+// Return the salted hash of an original value
+func (audit *Audit) hash(v interface{}) string {
+	data, ok := v.(string)
+	if !ok {
+		data = string(marshal(v))
+	}
+	mac := hmac.New(sha256.New, audit.salt)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Flush and close the audit log, and return the first error of writing
+func (audit *Audit) Close() error {
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	err := audit.writer.Flush()
+	if err != nil && audit.err == nil {
+		audit.err = &json_error.IOError{Path: audit.path, Message: "Error: Cannot write to '" + audit.path + "'", Err: err}
+	}
+	err = audit.file.Close()
+	if err != nil && audit.err == nil {
+		audit.err = &json_error.IOError{Path: audit.path, Message: "Error: Failed to close file '" + audit.path + "'", Err: err}
+	}
+	return audit.err
+}
+
+// change struct represents a value replaced, added or removed by a rule, at its location in the record
+// Added values have no original value
+type change struct {
+	location []interface{}
+	original interface{}
+	action   string
+}
+
+// changeLog struct collects the changes made by a rule on a record where the rule makes them,
+// it is nil if the changes are neither reported nor audited
+type changeLog struct {
+	changes []*change
+}
+
+// Record a change at the location, removed maps and arrays are recorded by their scalar values
+func (log *changeLog) add(location []interface{}, original interface{}, action string) {
+	if log == nil {
+		return
+	}
+	// Locations are copied since the locations of json_path are only valid while they are visited
+	if action == actionRemove {
+		leaves(location, original, func(l []interface{}, v interface{}) {
+			log.changes = append(log.changes, &change{location: append([]interface{}{}, l...), original: v, action: action})
+		})
+		return
+	}
+	log.changes = append(log.changes, &change{location: append([]interface{}{}, location...), original: original, action: action})
+}
+
+// Return the location of a key or an index below a location, which is only tracked if changes are recorded
+func (log *changeLog) step(location []interface{}, s interface{}) []interface{} {
+	if log == nil {
+		return nil
+	}
+	return step(location, s)
+}
+
+// Return if a value exists at the location in a decoded value
+func exists(v interface{}, location []interface{}) bool {
+	for _, s := range location {
+		switch s := s.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			v, ok = m[s]
+			if !ok {
+				return false
+			}
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || s >= len(a) {
+				return false
+			}
+			v = a[s]
+		}
+	}
+	return true
+}
+
+// Call the function with the location of every scalar value in a decoded value,
+// or with the value itself if it is an empty map or array
+func leaves(location []interface{}, v interface{}, fn func([]interface{}, interface{})) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) > 0 {
+			var keys []string
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				leaves(step(location, k), v[k], fn)
+			}
+			return
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			for i, e := range v {
+				leaves(step(location, i), e, fn)
+			}
+			return
+		}
+	}
+	fn(location, v)
+}
+
+// Return the location of a key or an index below a location
+func step(location []interface{}, s interface{}) []interface{} {
+	return append(append([]interface{}{}, location...), s)
+}
@@ -2,15 +2,55 @@ package json_replace
 
 import (
 	"flag"
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
 	"path/filepath"
 )
 
+// Modes of the program, which replaces values by the rules, or restores tokenized values from a vault
+const (
+	ModeReplace    = "replace"
+	ModeDetokenize = "detokenize"
+)
+
 type Config struct {
+	// Mode of the program, replace or detokenize
+	mode string
+
 	inputPath   string
 	outputPath  string
 	rulePath    string
 	lineByLine  bool
 	maxRoutines int
+	vaultPath   string
+	vaultKey    string
+	stream      bool
+	faithful    bool
+	whitespace  bool
+
+	// Whether replay timestamps are assigned in the order of file paths and lines
+	reproducible bool
+
+	// Target of records paced at their replay times in replay mode, and the speed multiplier
+	replayTarget string
+	replaySpeed  float64
+
+	// Path to the audit log of every change, and the salt of hashes of original values in it
+	auditPath string
+	auditSalt string
+
+	// Path to the report of dry-run mode, which writes nothing else if specified
+	reportPath string
+
+	// Format of compression of output files, which is empty if they are not compressed
+	compress string
+
+	// Whether the arguments and the rule file are only checked
+	validate bool
+
+	// Policy of handling invalid records, and the path to the dead-letter file of quarantined records
+	errorPolicy    json_error.Policy
+	deadLetterPath string
 }
 
 func NewConfig(inputPath string, outputPath string, rulePath string, lineByline bool, maxRoutines int) *Config {
@@ -19,6 +59,7 @@ func NewConfig(inputPath string, outputPath string, rulePath string, lineByline
 	outputPath = filepath.Clean(outputPath)
 
 	c := Config{
+		mode:        ModeReplace,
 		inputPath:   inputPath,
 		outputPath:  outputPath,
 		rulePath:    rulePath,
@@ -32,15 +73,133 @@ func NewDefaultConfig(inputPath string, outputPath string, rulePath string) *Con
 	return NewConfig(inputPath, outputPath, rulePath, false, 10)
 }
 
+func NewDetokenizeConfig(inputPath string, outputPath string, vaultPath string, vaultKey string, lineByLine bool, maxRoutines int) *Config {
+	c := NewConfig(inputPath, outputPath, "", lineByLine, maxRoutines)
+	c.mode = ModeDetokenize
+	c.SetVault(vaultPath, vaultKey)
+	return c
+}
+
+// Enable stream mode if the input is stdin or the output is stdout, which are streams of JSON records,
+// one per line, so that they also require line-by-line mode
+func (c *Config) standardStreams() error {
+	if c.inputPath != json_compress.Stdio && c.outputPath != json_compress.Stdio {
+		return nil
+	}
+	if !c.lineByLine {
+		return &json_error.ConfigError{Message: "Error: Input from stdin and output to stdout require line-by-line mode"}
+	}
+	c.stream = true
+	return nil
+}
+
+// Set the mode of the program, replace or detokenize, which restores tokenized values from the vault
+// at the vault path with the vault key instead of applying rules
+func (c *Config) SetMode(mode string) {
+	c.mode = mode
+}
+
+// Set the path to the vault and its key, from which tokenized values are restored in detokenize mode
+func (c *Config) SetVault(vaultPath string, vaultKey string) {
+	c.vaultPath = vaultPath
+	c.vaultKey = vaultKey
+}
+
+// Enable or disable stream mode
+func (c *Config) SetStream(stream bool) {
+	c.stream = stream
+}
+
+// Enable or disable faithful mode, which keeps the key order, number literals and string escaping
+// of the input, and also its whitespace if whitespace is true
+func (c *Config) SetFaithful(faithful bool, whitespace bool) {
+	c.faithful = faithful
+	c.whitespace = faithful && whitespace
+}
+
+// Enable or disable reproducible mode, which assigns replay timestamps in the order of file paths and lines,
+// so that runs over the same input produce the same timestamps while files are still processed concurrently
+func (c *Config) SetReproducible(reproducible bool) {
+	c.reproducible = reproducible
+}
+
+// Enable replay mode, which emits records to the target paced at the replay times of the first timestamp rule
+// instead of writing output files
+// The target is - for stdout, tcp://host:port or udp://host:port for a socket, or a path to a file to append to
+// A speed of 2 replays twice as fast as the replay times
+func (c *Config) SetReplay(target string, speed float64) {
+	c.replayTarget = target
+	c.replaySpeed = speed
+}
+
+// Record every change made by the rules in the audit log at the path if it is not empty,
+// where original values are only written as their hashes salted by the salt
+func (c *Config) SetAudit(auditPath string, salt string) {
+	c.auditPath = auditPath
+	c.auditSalt = salt
+}
+
+// Enable dry-run mode if the report path is not empty, which processes everything without writing outputs,
+// and writes a report of the impact of each rule to the path, or to stdout if the path is -
+func (c *Config) SetDryRun(reportPath string) {
+	c.reportPath = reportPath
+}
+
+// Set the format of compression of output files, gzip or zstd, or disable it with an empty format
+func (c *Config) SetCompress(compression string) {
+	c.compress = compression
+}
+
+// Enable or disable validate mode, which only checks the arguments and the rule file and reports every problem
+func (c *Config) SetValidate(validate bool) {
+	c.validate = validate
+}
+
+// Set the policy of handling records not in valid JSON format, which is fail, skip or quarantine
+// Quarantined records are written with the reason to the dead-letter file
+func (c *Config) SetErrorPolicy(policy json_error.Policy, deadLetterPath string) {
+	c.errorPolicy = policy
+	c.deadLetterPath = deadLetterPath
+}
+
 func NewConfigFromConsole() *Config {
 	// Config and parse flags
+	mode := flag.String("m", ModeReplace, "mode of replace or detokenize")
 	inputPath := flag.String("i", "", "input path")
 	outputPath := flag.String("o", "", "output path")
 	rulePath := flag.String("r", "", "rule path")
 	lineByLine := flag.Bool("l", false, "line-by-line mode")
 	maxRoutines := flag.Int("n", 10, "maximum routines")
+	vaultPath := flag.String("v", "", "vault path")
+	vaultKey := flag.String("k", "", "vault key")
+	stream := flag.Bool("s", false, "stream mode")
+	faithful := flag.Bool("f", false, "faithful mode")
+	whitespace := flag.Bool("w", false, "keep whitespace in faithful mode")
+	reproducible := flag.Bool("t", false, "reproducible timestamps")
+	replayTarget := flag.String("p", "", "replay target")
+	replaySpeed := flag.Float64("x", 1, "replay speed")
+	auditPath := flag.String("a", "", "audit log path")
+	auditSalt := flag.String("z", "", "salt of hashes in the audit log")
+	reportPath := flag.String("y", "", "dry-run report path")
+	validate := flag.Bool("c", false, "validate the arguments and the rule file")
+	errorPolicy := flag.String("e", "fail", "error policy of fail, skip or quarantine")
+	deadLetterPath := flag.String("d", "", "dead-letter path")
+	var compression json_compress.Compression
+	flag.Var(&compression, "g", "compress outputs by gzip, or by the format of -g=format")
 
 	flag.Parse()
 
-	return NewConfig(*inputPath, *outputPath, *rulePath, *lineByLine, *maxRoutines)
+	c := NewConfig(*inputPath, *outputPath, *rulePath, *lineByLine, *maxRoutines)
+	c.mode = *mode
+	c.SetVault(*vaultPath, *vaultKey)
+	c.stream = *stream
+	c.SetFaithful(*faithful, *whitespace)
+	c.reproducible = *reproducible
+	c.SetReplay(*replayTarget, *replaySpeed)
+	c.SetAudit(*auditPath, *auditSalt)
+	c.reportPath = *reportPath
+	c.compress = string(compression)
+	c.validate = *validate
+	c.SetErrorPolicy(json_error.Policy(*errorPolicy), *deadLetterPath)
+	return c
 }
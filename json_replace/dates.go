@@ -0,0 +1,95 @@
+package json_replace
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// Layouts of date strings in the order they are tried
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// Parse a date value, which is either a string in one of the date layouts or a number of epoch milliseconds
+// Return the time and a function to format a time in the same representation as the value
+func parseDate(v interface{}) (time.Time, func(time.Time) interface{}, bool) {
+	switch v.(type) {
+	case string:
+		for _, layout := range dateLayouts {
+			t, err := time.Parse(layout, v.(string))
+			if err == nil {
+				layout := layout
+				return t, func(t time.Time) interface{} { return t.Format(layout) }, true
+			}
+		}
+	case float64, json.Number:
+		f, ok := toFloat(v)
+		if !ok {
+			break
+		}
+		t := time.UnixMilli(int64(f)).UTC()
+		return t, func(t time.Time) interface{} { return t.UnixMilli() }, true
+	}
+	return time.Time{}, nil, false
+}
+
+// Truncate a date to the start of its hour, day, month or year
+func (r *Rule) truncateDate(v interface{}) interface{} {
+	t, format, ok := parseDate(v)
+	if !ok {
+		return v
+	}
+
+	switch r.Unit {
+	case "hour":
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case "day":
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case "month":
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	case "year":
+		t = time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	}
+	return format(t)
+}
+
+// Shift a date by the offset of the entity of the record
+func (r *Rule) shiftDate(v interface{}) interface{} {
+	t, format, ok := parseDate(v)
+	if !ok {
+		return v
+	}
+	return format(t.AddDate(0, 0, r.offset))
+}
+
+// Return the offset in days of an entity, which is derived from the key by HMAC-SHA256
+// so that all dates of the same entity are shifted by the same number of days
+func (r *Rule) entityOffset(entity interface{}) int {
+	mac := hmac.New(sha256.New, []byte(r.Key))
+	mac.Write(entityData(entity))
+	n := binary.BigEndian.Uint64(mac.Sum(nil))
+
+	// Map to [-max-days, max-days]
+	return int(n%uint64(2*r.MaxDays+1)) - r.MaxDays
+}
+
+// Return the bytes identifying an entity, which are the string itself for strings or the JSON representation otherwise
+// Numbers are encoded as their canonical literals, so that the same number in different representations
+// identifies the same entity
+func entityData(entity interface{}) []byte {
+	var data []byte
+	if s, ok := entity.(string); ok {
+		data = []byte(s)
+	} else if literal, ok := numberLiteral(entity); ok {
+		data = []byte(literal)
+	} else if entity != nil {
+		data, _ = json.Marshal(entity)
+	}
+	return data
+}
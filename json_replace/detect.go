@@ -0,0 +1,175 @@
+package json_replace
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// detector struct represents a built-in detector of sensitive information
+type detector struct {
+	name        string
+	pattern     *regexp.Regexp
+	valid       func(string) bool
+	placeholder string
+
+	// Whether matches must not be next to letters, digits, underscores or colons
+	bounded bool
+}
+
+// Built-in detectors in the order they are applied
+// Credit cards and SSNs are detected before phone numbers, MACs before IPv6 addresses,
+// so that a more specific detector always wins over a looser one
+var builtinDetectors = []*detector{
+	{
+		name:        "email",
+		pattern:     regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+		placeholder: "<EMAIL>",
+	},
+	{
+		name:        "credit-card",
+		pattern:     regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		valid:       validCreditCard,
+		placeholder: "<CREDIT_CARD>",
+	},
+	{
+		name:        "ssn",
+		pattern:     regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+		valid:       validSSN,
+		placeholder: "<SSN>",
+	},
+	{
+		name:        "mac",
+		pattern:     regexp.MustCompile(`\b[0-9A-Fa-f]{2}(?:[:-][0-9A-Fa-f]{2}){5}\b`),
+		placeholder: "<MAC>",
+	},
+	{
+		// Addresses are bounded and have at least two groups, so that std::vector or a::b is not an address
+		name:        "ipv6",
+		pattern:     regexp.MustCompile(`[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}(?:\.\d{1,3}){0,3}`),
+		valid:       validIPv6,
+		placeholder: "<IPV6>",
+		bounded:     true,
+	},
+	{
+		name:        "ipv4",
+		pattern:     regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`),
+		placeholder: "<IPV4>",
+	},
+	{
+		name:        "phone",
+		pattern:     regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{3}\) ?|\b\d{3}[ .-])\d{3}[ .-]\d{4}\b`),
+		placeholder: "<PHONE>",
+	},
+}
+
+// Return the built-in detector by name
+func builtinDetector(name string) *detector {
+	for _, d := range builtinDetectors {
+		if d.name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// Create the detectors of a rule from the map of detector names to placeholders
+// All built-in detectors are enabled if the map is empty
+// An empty placeholder falls back to the default placeholder of the detector, and unknown names are ignored,
+// which are reported by the check of the rule
+func newDetectors(placeholders map[string]string) []*detector {
+	var detectors []*detector
+	for _, d := range builtinDetectors {
+		placeholder, found := placeholders[d.name]
+		if len(placeholders) != 0 && !found {
+			continue
+		}
+		if placeholder == "" {
+			placeholder = d.placeholder
+		}
+		detectors = append(detectors, &detector{
+			name:        d.name,
+			pattern:     d.pattern,
+			valid:       d.valid,
+			placeholder: placeholder,
+			bounded:     d.bounded,
+		})
+	}
+	return detectors
+}
+
+// Replace every match of the detectors in a string with their placeholders
+func (r *Rule) detect(s string) string {
+	for _, d := range r.detectors {
+		s = d.replace(s)
+	}
+	return s
+}
+
+// Replace every valid match of the detector in a string with its placeholder
+func (d *detector) replace(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range d.pattern.FindAllStringIndex(s, -1) {
+		match := s[loc[0]:loc[1]]
+		if d.valid != nil && !d.valid(match) {
+			continue
+		}
+		if d.bounded && (loc[0] > 0 && continuesWord(s[loc[0]-1]) || loc[1] < len(s) && continuesWord(s[loc[1]])) {
+			continue
+		}
+		b.WriteString(s[last:loc[0]])
+		b.WriteString(d.placeholder)
+		last = loc[1]
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Return if the character continues a word or an address, so that a bounded match cannot be next to it
+func continuesWord(c byte) bool {
+	return c == '_' || c == ':' || '0' <= c && c <= '9' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z'
+}
+
+// Return if the number passes the Luhn checksum
+func validCreditCard(s string) bool {
+	s = strings.NewReplacer(" ", "", "-", "").Replace(s)
+	if len(s) < 13 || len(s) > 19 {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(s) - 1; i >= 0; i-- {
+		d := int(s[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// Return if the number is a possible US social security number
+// Area 000, 666 and 900-999, group 00 and serial 0000 are never assigned
+func validSSN(s string) bool {
+	area, group, serial := s[0:3], s[4:6], s[7:11]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// Return if the string is a valid IPv6 address with at least two groups
+func validIPv6(s string) bool {
+	groups := 0
+	for _, g := range strings.Split(s, ":") {
+		if g != "" {
+			groups++
+		}
+	}
+	return groups >= 2 && net.ParseIP(s) != nil
+}
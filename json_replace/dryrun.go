@@ -0,0 +1,159 @@
+package json_replace
+
+import (
+	"encoding/json"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"github.com/Joker-Jane/JSON-replacement/json_path"
+	"os"
+	"sync"
+)
+
+// Samples of before and after values reported for each rule
+const reportSamples = 3
+
+// Report struct represents the impact of the rules reported in dry-run mode
+type Report struct {
+	Files   int           `json:"files"`
+	Records int           `json:"records"`
+	Dropped int           `json:"dropped"`
+	Invalid int           `json:"invalid"`
+	Rules   []*RuleReport `json:"rules"`
+
+	// Reports of rules, and the lock for updating them
+	rules map[*Rule]*RuleReport
+	lock  sync.Mutex
+}
+
+// RuleReport struct represents the impact of a single rule
+// Records are the records changed or dropped by the rule, and fields are the values changed, added or removed
+type RuleReport struct {
+	Order     int                     `json:"order"`
+	Type      string                  `json:"type"`
+	FieldName string                  `json:"field-name,omitempty"`
+	Records   int                     `json:"records"`
+	Fields    int                     `json:"fields"`
+	Files     map[string]*ImpactCount `json:"files"`
+	Samples   []*Sample               `json:"samples"`
+}
+
+// ImpactCount struct represents the impact of a rule on a single file
+type ImpactCount struct {
+	Records int `json:"records"`
+	Fields  int `json:"fields"`
+}
+
+// Sample struct represents a record before and after a rule is applied
+// Line is the line of the record in line-by-line mode, and location is the JSON pointer to the element
+// in stream mode, after is null if the record is dropped
+type Sample struct {
+	File     string          `json:"file"`
+	Line     int             `json:"line,omitempty"`
+	Location string          `json:"location,omitempty"`
+	Before   json.RawMessage `json:"before"`
+	After    json.RawMessage `json:"after"`
+}
+
+// Create an empty report of the rules
+func newReport(rules []*Rule) *Report {
+	report := &Report{Rules: []*RuleReport{}, rules: map[*Rule]*RuleReport{}}
+	for _, r := range rules {
+		rr := &RuleReport{
+			Order:     r.Order,
+			Type:      r.Type,
+			FieldName: r.FieldName,
+			Files:     map[string]*ImpactCount{},
+			Samples:   []*Sample{},
+		}
+		report.Rules = append(report.Rules, rr)
+		report.rules[r] = rr
+	}
+	return report
+}
+
+// Record the impact of a rule on a record by the changes collected while the rule applies
+func (report *Report) add(r *Rule, state *fileState, prefix []interface{}, before interface{}, after interface{}, log *changeLog, dropped bool) {
+	// An element removed in stream mode is reported as dropped
+	if after == json_path.Delete {
+		dropped = true
+	}
+	fields := 0
+	if !dropped {
+		fields = len(log.changes)
+		if fields == 0 {
+			return
+		}
+	}
+
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	rr := report.rules[r]
+	rr.Records++
+	rr.Fields += fields
+	count, found := rr.Files[state.path]
+	if !found {
+		count = &ImpactCount{}
+		rr.Files[state.path] = count
+	}
+	count.Records++
+	count.Fields += fields
+
+	if len(rr.Samples) < reportSamples {
+		location := ""
+		for _, p := range prefix {
+			location = json_error.Pointer(location, p)
+		}
+		sample := &Sample{File: state.path, Line: state.line, Location: location, Before: marshal(before), After: json.RawMessage("null")}
+		if !dropped {
+			sample.After = marshal(after)
+		}
+		rr.Samples = append(rr.Samples, sample)
+	}
+}
+
+// Count a processed file, or a processed or invalid record
+func (report *Report) count(files int, records int, invalid int) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.Files += files
+	report.Records += records
+	report.Invalid += invalid
+}
+
+// Write the report in JSON format to the path, or to stdout if the path is -
+func (report *Report) write(path string, dropped int) error {
+	report.Dropped = dropped
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(content)
+		return err
+	}
+	err = os.WriteFile(path, content, 0666)
+	if err != nil {
+		return &json_error.IOError{Path: path, Message: "Error: Failed to write report '" + path + "'", Err: err}
+	}
+	return nil
+}
+
+// Return a deep copy of a decoded value
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = copyValue(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = copyValue(e)
+		}
+		return a
+	}
+	return v
+}
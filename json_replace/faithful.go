@@ -0,0 +1,288 @@
+package json_replace
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// rawValue struct records the location of a JSON value in the input
+type rawValue struct {
+	// Position of the first byte and the position after the last byte
+	start int
+	end   int
+
+	// Members of an object and elements of an array
+	members  []*rawMember
+	elements []*rawElement
+
+	// Position of the whitespace before the closing brace or bracket
+	tail int
+}
+
+// rawMember struct records the location of a member of an object
+type rawMember struct {
+	// Position of the whitespace before the key
+	lead int
+
+	// Position of the key and the decoded key
+	keyStart int
+	keyEnd   int
+	key      string
+
+	value *rawValue
+}
+
+// rawElement struct records the location of an element of an array
+type rawElement struct {
+	// Position of the whitespace before the element
+	lead int
+
+	value *rawValue
+}
+
+// Encode the processed value of a record
+// In faithful mode, everything not changed by rules is written exactly as it is in the input,
+// including key order, number literals and string escaping, and whitespace if enabled
+func (replace *JSONReplace) encode(v interface{}, input []byte) []byte {
+	if !replace.config.faithful {
+		result, _ := json.Marshal(v)
+		return result
+	}
+
+	raw, _ := scanValue(input, skipSpace(input, 0))
+	var buffer bytes.Buffer
+	writeFaithful(&buffer, v, raw, input)
+
+	// Fall back to encoding the whole value if the record cannot be written faithfully, so that it is never lost
+	var compact bytes.Buffer
+	err := json.Compact(&compact, buffer.Bytes())
+	if err != nil {
+		return marshal(v)
+	}
+	if !replace.config.whitespace {
+		return compact.Bytes()
+	}
+
+	// Keep the whitespace around the record
+	result := append([]byte{}, input[:raw.start]...)
+	result = append(result, buffer.Bytes()...)
+	return append(result, input[raw.end:]...)
+}
+
+// Decode a record, numbers are decoded as json.Number in faithful mode to keep their literals
+func (replace *JSONReplace) decode(input []byte) (interface{}, error) {
+	var v interface{}
+	if !replace.config.faithful {
+		err := json.Unmarshal(input, &v)
+		return v, err
+	}
+
+	// The input is validated first so that a syntax error reports its offset
+	var raw json.RawMessage
+	err := json.Unmarshal(input, &raw)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.UseNumber()
+	err = decoder.Decode(&v)
+	return v, err
+}
+
+// Write a processed value, reusing the input for everything unchanged
+func writeFaithful(buffer *bytes.Buffer, v interface{}, raw *rawValue, input []byte) {
+	switch v.(type) {
+	case map[string]interface{}:
+		if input[raw.start] == '{' {
+			writeObject(buffer, v.(map[string]interface{}), raw, input)
+			return
+		}
+	case []interface{}:
+		a := v.([]interface{})
+		// The elements can only be matched if no element is removed
+		if input[raw.start] == '[' && len(a) == len(raw.elements) {
+			writeArray(buffer, a, raw, input)
+			return
+		}
+	default:
+		if equalScalar(v, input[raw.start:raw.end]) {
+			buffer.Write(input[raw.start:raw.end])
+			return
+		}
+	}
+	buffer.Write(marshal(v))
+}
+
+// Write a processed object in the order of the keys in the input
+// Removed members are skipped, and added members are written at the end
+func writeObject(buffer *bytes.Buffer, m map[string]interface{}, raw *rawValue, input []byte) {
+	buffer.WriteByte('{')
+	written := map[string]bool{}
+	var last *rawMember
+	for _, member := range raw.members {
+		child, found := m[member.key]
+		if !found || written[member.key] {
+			continue
+		}
+		if last != nil {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(input[member.lead:member.keyStart])
+		buffer.Write(input[member.keyStart:member.keyEnd])
+		buffer.Write(input[member.keyEnd:member.value.start])
+		writeFaithful(buffer, child, member.value, input)
+		written[member.key] = true
+		last = member
+	}
+
+	// Added members follow the whitespace of the last member, and are separated by commas
+	// even if no member of the input is left
+	var added []string
+	for k := range m {
+		if !written[k] {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	for i, k := range added {
+		if last != nil || i > 0 {
+			buffer.WriteByte(',')
+		}
+		if last != nil {
+			buffer.Write(input[last.lead:last.keyStart])
+			buffer.Write(marshal(k))
+			buffer.Write(input[last.keyEnd:last.value.start])
+		} else {
+			buffer.Write(marshal(k))
+			buffer.WriteByte(':')
+		}
+		buffer.Write(marshal(m[k]))
+		written[k] = true
+	}
+
+	buffer.Write(input[raw.tail : raw.end-1])
+	buffer.WriteByte('}')
+}
+
+// Write a processed array with the same number of elements as in the input
+func writeArray(buffer *bytes.Buffer, a []interface{}, raw *rawValue, input []byte) {
+	buffer.WriteByte('[')
+	for i, element := range raw.elements {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(input[element.lead:element.value.start])
+		writeFaithful(buffer, a[i], element.value, input)
+	}
+	buffer.Write(input[raw.tail : raw.end-1])
+	buffer.WriteByte(']')
+}
+
+// Return if a processed scalar is equal to the literal in the input
+func equalScalar(v interface{}, literal []byte) bool {
+	decoder := json.NewDecoder(bytes.NewReader(literal))
+	decoder.UseNumber()
+	var original interface{}
+	if decoder.Decode(&original) != nil {
+		return false
+	}
+	switch original.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return v == original
+}
+
+// Encode a changed value without escaping HTML characters
+func marshal(v interface{}) []byte {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(v)
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n"))
+}
+
+// Scan a valid JSON value starting at i, return its location and the position after it
+func scanValue(input []byte, i int) (*rawValue, int) {
+	raw := &rawValue{start: i}
+	switch input[i] {
+	case '{':
+		i++
+		for {
+			lead := i
+			i = skipSpace(input, i)
+			if input[i] == '}' {
+				if len(raw.members) == 0 {
+					raw.tail = lead
+				}
+				break
+			}
+			member := &rawMember{lead: lead, keyStart: i}
+			i = scanString(input, i)
+			member.keyEnd = i
+			_ = json.Unmarshal(input[member.keyStart:member.keyEnd], &member.key)
+
+			// Skip the colon
+			i = skipSpace(input, i) + 1
+			member.value, i = scanValue(input, skipSpace(input, i))
+			raw.members = append(raw.members, member)
+
+			raw.tail = i
+			i = skipSpace(input, i)
+			if input[i] == ',' {
+				i++
+			}
+		}
+		i++
+	case '[':
+		i++
+		for {
+			lead := i
+			i = skipSpace(input, i)
+			if input[i] == ']' {
+				if len(raw.elements) == 0 {
+					raw.tail = lead
+				}
+				break
+			}
+			element := &rawElement{lead: lead}
+			element.value, i = scanValue(input, i)
+			raw.elements = append(raw.elements, element)
+
+			raw.tail = i
+			i = skipSpace(input, i)
+			if input[i] == ',' {
+				i++
+			}
+		}
+		i++
+	case '"':
+		i = scanString(input, i)
+	default:
+		// Numbers, true, false and null end at a delimiter
+		for i < len(input) && bytes.IndexByte([]byte(",]} \t\r\n"), input[i]) < 0 {
+			i++
+		}
+	}
+	raw.end = i
+	return raw, i
+}
+
+// Scan a string starting at its opening quote, return the position after its closing quote
+func scanString(input []byte, i int) int {
+	for i++; input[i] != '"'; i++ {
+		if input[i] == '\\' {
+			i++
+		}
+	}
+	return i + 1
+}
+
+// Return the position of the first non-whitespace byte from i
+func skipSpace(input []byte, i int) int {
+	for i < len(input) && (input[i] == ' ' || input[i] == '\t' || input[i] == '\r' || input[i] == '\n') {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,151 @@
+package json_replace
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Word lists of fake values, one word per line
+var (
+	//go:embed words/first-names.txt
+	firstNamesText string
+	//go:embed words/last-names.txt
+	lastNamesText string
+	//go:embed words/company-names.txt
+	companyNamesText string
+	//go:embed words/company-suffixes.txt
+	companySuffixesText string
+	//go:embed words/streets.txt
+	streetsText string
+	//go:embed words/street-suffixes.txt
+	streetSuffixesText string
+	//go:embed words/cities.txt
+	citiesText string
+	//go:embed words/domains.txt
+	domainsText string
+
+	firstNames      = words(firstNamesText)
+	lastNames       = words(lastNamesText)
+	companyNames    = words(companyNamesText)
+	companySuffixes = words(companySuffixesText)
+	streets         = words(streetsText)
+	streetSuffixes  = words(streetSuffixesText)
+	cities          = words(citiesText)
+	domains         = words(domainsText)
+)
+
+// person struct represents a fake identity, which every kind of fake value is derived from
+type person struct {
+	first string
+	last  string
+}
+
+// Generators of fake values by kind, from a fake identity, a random source seeded by the same identity
+// and the original value as a string
+var fakers = map[string]func(p *person, rnd *rand.Rand, original string) string{
+	"name": func(p *person, rnd *rand.Rand, original string) string {
+		return p.first + " " + p.last
+	},
+	"first-name": func(p *person, rnd *rand.Rand, original string) string {
+		return p.first
+	},
+	"last-name": func(p *person, rnd *rand.Rand, original string) string {
+		return p.last
+	},
+	"email": func(p *person, rnd *rand.Rand, original string) string {
+		return strings.ToLower(p.first+"."+p.last) + "@" + pick(rnd, domains)
+	},
+	"username": func(p *person, rnd *rand.Rand, original string) string {
+		return strings.ToLower(p.first[:1]+p.last) + fmt.Sprintf("%02d", rnd.Intn(100))
+	},
+	"company": func(p *person, rnd *rand.Rand, original string) string {
+		return pick(rnd, companyNames) + " " + pick(rnd, companySuffixes)
+	},
+	"address": func(p *person, rnd *rand.Rand, original string) string {
+		return fmt.Sprintf("%d %s %s, %s", rnd.Intn(9999)+1, pick(rnd, streets), pick(rnd, streetSuffixes), pick(rnd, cities))
+	},
+	"phone": func(p *person, rnd *rand.Rand, original string) string {
+		// Numbers 555-0100 to 555-0199 are reserved for fictional use
+		return fmt.Sprintf("+1-%d-555-01%02d", rnd.Intn(800)+200, rnd.Intn(100))
+	},
+	"uuid": func(p *person, rnd *rand.Rand, original string) string {
+		b := make([]byte, 16)
+		rnd.Read(b)
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	},
+	"ip": func(p *person, rnd *rand.Rand, original string) string {
+		// Addresses are private, IPv6 addresses are replaced by unique local addresses
+		ip := net.ParseIP(original)
+		if ip != nil && ip.To4() == nil {
+			b := make(net.IP, net.IPv6len)
+			rnd.Read(b)
+			b[0] = 0xfd
+			return b.String()
+		}
+		return fmt.Sprintf("10.%d.%d.%d", rnd.Intn(256), rnd.Intn(256), rnd.Intn(254)+1)
+	},
+}
+
+// Return the non-empty lines of a word list
+func words(text string) []string {
+	var list []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			list = append(list, line)
+		}
+	}
+	return list
+}
+
+// Return a random word of a word list
+func pick(rnd *rand.Rand, list []string) string {
+	return list[rnd.Intn(len(list))]
+}
+
+// Replace a string or number by a fake value of the kind of the rule
+// The value is seeded by the entity of the record if the rule specifies one, or by the value itself otherwise,
+// so that fake values of the same entity or value are the same in every record and file
+func (r *Rule) fake(v interface{}) interface{} {
+	var original string
+	switch v := v.(type) {
+	case string:
+		original = v
+	default:
+		if _, ok := toFloat(v); !ok {
+			return v
+		}
+		original = string(marshal(v))
+	}
+
+	identity := r.identity
+	if identity == nil {
+		identity = entityData(v)
+	}
+	mac := hmac.New(sha256.New, []byte(r.Key))
+	mac.Write(identity)
+	rnd := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(mac.Sum(nil)))))
+
+	// The identity is drawn first, so that every kind of the same seed belongs to the same person
+	p := &person{first: pick(rnd, firstNames), last: pick(rnd, lastNames)}
+	return fakers[r.Kind](p, rnd, original)
+}
+
+// Return the kinds of fake values in a sorted list for error messages
+func fakeKinds() string {
+	var kinds []string
+	for kind := range fakers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return strings.Join(kinds[:len(kinds)-1], ", ") + " or " + kinds[len(kinds)-1]
+}
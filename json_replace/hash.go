@@ -0,0 +1,38 @@
+package json_replace
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Default number of hex characters in a pseudonym
+const defaultHashLength = 16
+
+// Replace a value with a keyed pseudonym
+// The pseudonym is the replacement as prefix followed by the truncated HMAC-SHA256 of the value,
+// so the same value is always mapped to the same pseudonym as long as the key is unchanged
+func (r *Rule) hash(v interface{}) interface{} {
+	var data []byte
+	if s, ok := v.(string); ok {
+		data = []byte(s)
+	} else if literal, ok := numberLiteral(v); ok {
+		// Numbers are hashed by their canonical literal so that 42 and "42" match
+		data = []byte(literal)
+	} else {
+		// Leave booleans and nulls untouched
+		return v
+	}
+
+	mac := hmac.New(sha256.New, []byte(r.Key))
+	mac.Write(data)
+	token := hex.EncodeToString(mac.Sum(nil))
+
+	length := r.Length
+	if length <= 0 {
+		length = defaultHashLength
+	} else if length > len(token) {
+		length = len(token)
+	}
+	return r.Replacement + token[:length]
+}
@@ -0,0 +1,80 @@
+package json_replace
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"net"
+	"regexp"
+)
+
+// Pattern of IPv6 or IPv4 addresses in a string, built from the detectors
+var ipPattern = regexp.MustCompile(builtinDetector("ipv6").pattern.String() + "|" + builtinDetector("ipv4").pattern.String())
+
+// CryptoPAn struct anonymizes IP addresses with the prefix-preserving Crypto-PAn scheme
+// Two addresses sharing a prefix of n bits are anonymized to addresses sharing a prefix of n bits
+type CryptoPAn struct {
+	block cipher.Block
+	pad   []byte
+}
+
+// Create a Crypto-PAn anonymizer from a passphrase
+// The SHA-256 of the passphrase provides the AES-128 key and the secret pad
+func newCryptoPAn(passphrase string) *CryptoPAn {
+	key := sha256.Sum256([]byte(passphrase))
+	block, _ := aes.NewCipher(key[:16])
+	pad := make([]byte, aes.BlockSize)
+	block.Encrypt(pad, key[16:])
+	return &CryptoPAn{block: block, pad: pad}
+}
+
+// Anonymize an IPv4 address of 4 bytes or an IPv6 address of 16 bytes
+func (c *CryptoPAn) anonymize(ip []byte) []byte {
+	result := make([]byte, len(ip))
+	input := make([]byte, aes.BlockSize)
+	output := make([]byte, aes.BlockSize)
+
+	for i := 0; i < len(ip)*8; i++ {
+		// The input is the first i bits of the address followed by the pad
+		copy(input, c.pad)
+		copy(input, ip[:i/8])
+		if i%8 != 0 {
+			mask := byte(0xff) << (8 - i%8)
+			input[i/8] = ip[i/8]&mask | c.pad[i/8]&^mask
+		}
+		c.block.Encrypt(output, input)
+
+		// Flip the i-th bit by the first bit of the output
+		bit := (ip[i/8] >> (7 - i%8) & 1) ^ (output[0] >> 7)
+		result[i/8] |= bit << (7 - i%8)
+	}
+	return result
+}
+
+// Anonymize a string that is an IP address, other strings are returned untouched
+func (r *Rule) anonymizeIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+
+	bits := r.BitsV6
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+		bits = r.Bits
+	}
+
+	switch r.Mode {
+	case "prefix-preserving":
+		return net.IP(r.cryptoPAn.anonymize(ip)).String()
+	default:
+		mask := net.CIDRMask(len(ip)*8-bits, len(ip)*8)
+		return ip.Mask(mask).String()
+	}
+}
+
+// Anonymize every IP address found in a string
+// Addresses are found in a single pass so that an anonymized address is never anonymized again
+func (r *Rule) anonymizeIPs(s string) string {
+	return ipPattern.ReplaceAllStringFunc(s, r.anonymizeIP)
+}
@@ -6,7 +6,17 @@ private / client information in each based on some predefined parameters.
 -l and -n flags are optional.
 
 The input path and output path can be either a file or a directory.
-The rule path must be a JSON file in valid rule format.
+Input files compressed by gzip, bzip2 or zstd are decompressed while they are read, as done by package json_compress.
+
+The input path - reads records from stdin, and the output path - writes records to stdout, so that the program
+can be a part of a pipeline. Both are streams of JSON records, one per line, which require -l flag
+and are processed in stream mode. Records of every input file are written to stdout as whole lines.
+Stdin cannot be read by reproducible mode or timestamp rules of the preserve profile, which read the input twice.
+The rule path must be a JSON or YAML file in valid rule format, which may include other rule files
+and reference shared definitions, as loaded by package json_rules.
+Field names of rules are paths in the syntax of package json_path, such as events[0].user or **.token.
+A rule with a when block only applies to records meeting all of its conditions,
+which are evaluated by package json_condition in the same way as json_select.
 
 Reading multiple JSON objects line-by-line is supported by specifying -l flag.
 Note that a single JSON object in multiple lines is not supported if line-by-line mode is enabled.
@@ -21,10 +31,10 @@ Usage:
 Flags:
 
 	-i input_path
-		Set the path to the input file or directory.
+		Set the path to the input file or directory, or - for stdin.
 
 	-o output_path
-		Set the path to the output file or directory.
+		Set the path to the output file or directory, or - for stdout.
 
 	-r rule_path
 		Set the path to the rule file.
@@ -34,6 +44,85 @@ Flags:
 
 	-n [number of routines]
 		Set the maximum number of routines running simultaneously. Default: 10
+
+	-s
+		Process files incrementally with bounded memory. Default: false
+		Each line is read and written one at a time in line-by-line mode.
+		Otherwise, each element of a top-level array is processed and written one at a time.
+		The elements of arrays in a top-level object are spooled to a temporary file until the rest
+		of the object is processed as the record, then processed and written one at a time.
+
+	-f
+		Keep the key order, number literals and string escaping of the input. Default: false
+		Only values changed by rules are encoded again, and added keys are written after the others.
+
+	-w
+		Also keep the whitespace of the input in faithful mode. Default: false
+
+	-t
+		Assign replay timestamps in the order of file paths and lines. Default: false
+		Runs over the same input produce the same timestamps, given start-ms and seeds of timestamp rules.
+		The input is processed once more beforehand to count the timestamps of each file,
+		by the rules up to the last timestamp rule except tokenize rules.
+
+	-p target
+		Emit records to the target paced at the replay times of the first timestamp rule,
+		instead of writing output files. The target is - for stdout, tcp://host:port or
+		udp://host:port for a socket, or a path to a file to append to.
+		Records are lines in line-by-line mode, documents, or elements of arrays in stream mode.
+
+	-x speed
+		Set the speed multiplier of replay mode. Default: 1
+
+	-a audit_path
+		Record every change made by the rules in the audit log, such as a file alongside the output,
+		one JSON object per line with the file, the line in line-by-line mode, the path of the value,
+		the order and type of the rule, the action of replace, add, remove or drop,
+		and the hash of the original value salted by -z. Original values are never written.
+
+	-z salt
+		Set the salt of hashes of original values in the audit log, which must be specified with -a.
+
+	-c
+		Check the arguments and the rule file without processing anything, and report every problem,
+		located by the flag of the argument or by a JSON pointer into the array of rules loaded
+		from the rule file, such as /2/field-name.
+		Unknown types and fields, missing field-name, invalid regex patterns, timestamp rules
+		without a positive max-records, and duplicate orders are reported.
+
+	-y report_path
+		Process everything without writing outputs, vaults or the dead-letter file, and write a report
+		in JSON format to the path, or to stdout if the path is -. For each rule, the report counts
+		the records and the fields changed or dropped in total and in each file, with a few samples
+		of values before and after the rule.
+
+	-e policy
+		Set the policy of handling records not in valid JSON format. Default: fail
+		fail stops at the first invalid record, skip skips invalid records,
+		and quarantine also writes each of them with the reason to the dead-letter file.
+
+	-d dead_letter_path
+		Set the path to the dead-letter file of quarantined records.
+
+	-g[=format]
+		Compress output files by gzip, or by the format gzip or zstd given as -g=zstd. Default: false
+		The extension .gz, .bz2 or .zst of compressed input files is removed from output files
+		in the output directory, and .gz or .zst is appended to them if they are compressed.
+		An output file given explicitly is written to the path as it is.
+
+Tokenized values can be restored by -m detokenize, or by creating the object with NewJSONDetokenize,
+which requires -v and -k flags instead of -r flag.
+
+	-m mode
+		Set the mode to replace, which applies the rules, or detokenize, which restores tokenized values
+		from the vault. Default: replace
+
+	-v vault_path
+		Set the path to the vault file written by tokenize rules.
+
+	-k key
+		Set the key of the vault file, from which the key of encryption is derived by scrypt
+		with the random salt stored in the header of the vault file.
 */
 package json_replace
 
@@ -41,10 +130,17 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_condition"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"github.com/Joker-Jane/JSON-replacement/json_path"
+	"github.com/Joker-Jane/JSON-replacement/json_rules"
 	"io/fs"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -60,28 +156,126 @@ type JSONReplace struct {
 	// The list of all rules
 	rules []*Rule
 
+	// Rules applied when files are only counted in reproducible mode
+	countRules []*Rule
+
+	// Vaults of tokenize rules by path
+	vaults map[string]*Vault
+
 	// Synchronization
 	sync *Sync
+
+	// Handler of invalid records by the error policy
+	errors *json_error.Handler
+
+	// Pacer of records in replay mode
+	pacer *Pacer
+
+	// Stdout if the output path is -, which every file is written to
+	stdout *json_compress.File
+
+	// Impact of the rules in dry-run mode
+	report *Report
+
+	// Audit log of every change made by the rules
+	audit *Audit
 }
 
 // Rule struct represents a rule object
 type Rule struct {
-	Order       int    `json:"order"`
-	Type        string `json:"type"`
-	FieldName   string `json:"field-name"`
-	Original    string `json:"original"`
-	Replacement string `json:"replacement"`
-	Duration    int64  `json:"duration"`
-	MaxRecords  int64  `json:"max-records"`
-	StartMs     int64  `json:"start-ms"`
+	Order       int                         `json:"order"`
+	Type        string                      `json:"type"`
+	FieldName   string                      `json:"field-name"`
+	Original    string                      `json:"original"`
+	Replacement string                      `json:"replacement"`
+	Duration    int64                       `json:"duration"`
+	MaxRecords  int64                       `json:"max-records"`
+	StartMs     int64                       `json:"start-ms"`
+	Format      string                      `json:"format"`
+	Timezone    string                      `json:"timezone"`
+	Profile     string                      `json:"profile"`
+	BurstSize   int                         `json:"burst-size"`
+	PeakHour    *int                        `json:"peak-hour"`
+	Amplitude   float64                     `json:"amplitude"`
+	Key         string                      `json:"key"`
+	Length      int                         `json:"length"`
+	Detectors   map[string]string           `json:"detectors"`
+	Vault       string                      `json:"vault"`
+	Noise       float64                     `json:"noise"`
+	Seed        int64                       `json:"seed"`
+	Digits      int                         `json:"digits"`
+	Step        float64                     `json:"step"`
+	Min         *float64                    `json:"min"`
+	Max         *float64                    `json:"max"`
+	Buckets     []*Bucket                   `json:"buckets"`
+	Value       json.RawMessage             `json:"value"`
+	Match       json.RawMessage             `json:"match"`
+	Unit        string                      `json:"unit"`
+	Entity      string                      `json:"entity"`
+	Kind        string                      `json:"kind"`
+	MaxDays     int                         `json:"max-days"`
+	Mode        string                      `json:"mode"`
+	Bits        int                         `json:"bits"`
+	BitsV6      int                         `json:"bits-v6"`
+	Keys        []string                    `json:"keys"`
+	KeyRegex    string                      `json:"key-regex"`
+	Action      string                      `json:"action"`
+	When        []*json_condition.Condition `json:"when"`
 	replay      Replay
+	pattern     *regexp.Regexp
+	detectors   []*detector
+	vault       *Vault
+	noise       *Noise
+	keyPattern  *regexp.Regexp
+	match       []byte
+	offset      int
+	identity    []byte
+	cryptoPAn   *CryptoPAn
+	path        *json_path.Path
+	entity      *json_path.Path
+	location    *time.Location
+}
+
+// fileState struct records the state of processing a single file
+type fileState struct {
+	// Path to the input file
+	path string
+
+	// Replay states of timestamp rules in reproducible mode, which replace the states shared between files
+	replays map[*Rule]*Replay
+
+	// Whether the file is only processed to count its timestamps, without writing anything
+	counting bool
+
+	// Line of the current record in line-by-line mode
+	line int
+
+	// Replay time of the current record in replay mode, and whether it is assigned
+	time  int64
+	timed bool
+
+	// Rest of the record before every rule in stream mode, which is recorded while the rest is processed,
+	// so that the rules on the elements of its arrays see the rest of the record
+	records   []interface{}
+	recording bool
 }
 
+// Returned by the walk function to stop walking once a routine fails
+var errStopped = errors.New("stopped")
+
 // Replay struct records replay related fields
 type Replay struct {
 	time    float64
 	index   int64
 	records int64
+
+	// Start time, and random source of random profiles
+	start  float64
+	random *rand.Rand
+
+	// Earliest original time in milliseconds and the scale of gaps in the preserve profile
+	first float64
+	scale float64
 }
 
 // Sync struct ensures synchronization
@@ -92,53 +286,84 @@ type Sync struct {
 	// Processed files
 	processCounter int
 
+	// Dropped records
+	dropCounter int
+
+	// The first error of routines
+	first json_error.First
+
 	// Lock for updating file counter
 	lock sync.Mutex
 }
 
 // Create a JSONReplace Object
-func NewJSONReplace(config *Config) *JSONReplace {
+func NewJSONReplace(config *Config) (*JSONReplace, error) {
+	// Only check the arguments and the rule file in validate mode
+	if config.validate {
+		err := Validate(config)
+		if err != nil {
+			return nil, err
+		}
+		return &JSONReplace{config: config}, nil
+	}
+
+	// Tokenized values are restored from the vault in detokenize mode
+	switch config.mode {
+	case ModeReplace:
+	case ModeDetokenize:
+		return NewJSONDetokenize(config)
+	default:
+		return nil, &json_error.ConfigError{Message: "Error: Mode must be " + ModeReplace + " or " + ModeDetokenize}
+	}
+
 	// Check if all arguments are specified
 	if config.inputPath == "" || config.rulePath == "" || config.outputPath == "" {
-		log.Fatal("Usage: ./json_replace -i input -o output -r rule [-l] [-n routines]")
+		return nil, &json_error.ConfigError{Message: "Usage: ./json_replace -i input -o output -r rule [-l] [-n routines]"}
 	}
 
 	// Check if max routines is positive
 	if config.maxRoutines <= 0 {
-		log.Fatal("Error: Maximum number of routines must be greater than 0")
+		return nil, &json_error.ConfigError{Message: "Error: Maximum number of routines must be greater than 0"}
+	}
+
+	// Check if outputs can be compressed in the format
+	if err := json_compress.Check(config.compress); err != nil {
+		return nil, &json_error.ConfigError{Message: "Error: " + err.Error()}
 	}
 
 	// Check if input path exists
-	_, err := os.Stat(config.inputPath)
+	err := checkInput(config.inputPath)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			log.Fatal("Error: Input path '" + config.inputPath + "' not found")
-		} else {
-			log.Fatal("Error: Cannot read input path '" + config.inputPath + "'")
-		}
+		return nil, err
 	}
 
 	// Check if config file exists
 	_, err = os.Stat(config.rulePath)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			log.Fatal("Error: Config file '" + config.rulePath + "' not found")
+			return nil, &json_error.IOError{Path: config.rulePath, Message: "Error: Config file '" + config.rulePath + "' not found", Err: err}
 		} else {
-			log.Fatal("Error: Cannot read rule file '" + config.rulePath + "'")
+			return nil, &json_error.IOError{Path: config.rulePath, Message: "Error: Cannot read rule file '" + config.rulePath + "'", Err: err}
 		}
 	}
 
-	// Read config file
-	rule, err := os.ReadFile(config.rulePath)
+	// Read config file and the files it includes
+	rule, err := json_rules.Load(config.rulePath)
 	if err != nil {
-		log.Fatal("Error: Cannot read rule file '" + config.rulePath + "'")
+		return nil, err
 	}
 
 	// Parse config file and store to rules
 	var rules []*Rule
 	err = json.Unmarshal(rule, &rules)
 	if err != nil {
-		log.Fatal("Error: Rule file must be in the format of arrays of rule json objects")
+		// Locate the problems of the rule file
+		validateErr := &json_error.ValidationError{}
+		validateRules(rule, validateErr)
+		if validateErr.Err() != nil {
+			return nil, validateErr
+		}
+		return nil, &json_error.RuleError{Message: "Error: Rule file must be in the format of arrays of rule json objects"}
 	}
 
 	// Sort the rules by order
@@ -150,56 +375,337 @@ func NewJSONReplace(config *Config) *JSONReplace {
 	replace := &JSONReplace{
 		config: config,
 		rules:  rules,
+		vaults: map[string]*Vault{},
 		sync:   new(Sync),
 	}
 
-	return replace
+	// Prepare every rule before processing
+	for _, r := range rules {
+		err = r.prepare()
+		if err != nil {
+			return nil, err
+		}
+		if r.Type == "tokenize" {
+			r.vault, err = replace.openVault(r.Vault, r.Key)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Stdin can only be read once
+	if config.inputPath == json_compress.Stdio && scansInput(config, rules) {
+		return nil, &json_error.ConfigError{Message: "Error: Input from stdin cannot be read by reproducible mode or timestamp rules of the preserve profile"}
+	}
+	err = config.standardStreams()
+	if err != nil {
+		return nil, err
+	}
+
+	// Original values in the audit log are hashed with a salt
+	if config.auditPath != "" && config.auditSalt == "" {
+		return nil, &json_error.ConfigError{Message: "Error: Audit log must specify a salt"}
+	}
+
+	// Replay mode is paced by the first timestamp rule
+	if config.replayTarget != "" {
+		if config.replaySpeed <= 0 {
+			return nil, &json_error.ConfigError{Message: "Error: Replay speed must be greater than 0"}
+		}
+		if replace.pacingRule() == nil {
+			return nil, &json_error.ConfigError{Message: "Error: Replay mode requires a timestamp rule"}
+		}
+	}
+
+	// Nothing is written in dry-run mode, including the dead-letter file
+	policy := config.errorPolicy
+	if config.reportPath != "" {
+		replace.report = newReport(rules)
+		if policy == json_error.Quarantine {
+			policy = json_error.Skip
+		}
+	}
+
+	replace.errors, err = json_error.NewHandler(policy, config.deadLetterPath)
+	if err != nil {
+		return nil, err
+	}
+	return replace, nil
+}
+
+// Create a JSONReplace Object that restores tokenized values from a vault
+func NewJSONDetokenize(config *Config) (*JSONReplace, error) {
+	// Check if all arguments are specified
+	if config.inputPath == "" || config.outputPath == "" || config.vaultPath == "" {
+		return nil, &json_error.ConfigError{Message: "Usage: ./json_replace -i input -o output -v vault -k key [-l] [-n routines]"}
+	}
+
+	// Check if max routines is positive
+	if config.maxRoutines <= 0 {
+		return nil, &json_error.ConfigError{Message: "Error: Maximum number of routines must be greater than 0"}
+	}
+
+	// Check if outputs can be compressed in the format
+	if err := json_compress.Check(config.compress); err != nil {
+		return nil, &json_error.ConfigError{Message: "Error: " + err.Error()}
+	}
+
+	// Check if input path exists
+	err := checkInput(config.inputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if vault file exists
+	_, err = os.Stat(config.vaultPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, &json_error.IOError{Path: config.vaultPath, Message: "Error: Vault file '" + config.vaultPath + "' not found", Err: err}
+		} else {
+			return nil, &json_error.IOError{Path: config.vaultPath, Message: "Error: Cannot read vault file '" + config.vaultPath + "'", Err: err}
+		}
+	}
+
+	err = config.standardStreams()
+	if err != nil {
+		return nil, err
+	}
+
+	// Construct JSONReplace object with a single detokenize rule
+	replace := &JSONReplace{
+		config: config,
+		vaults: map[string]*Vault{},
+		sync:   new(Sync),
+	}
+	v, err := replace.openVault(config.vaultPath, config.vaultKey)
+	if err != nil {
+		return nil, err
+	}
+	replace.rules = []*Rule{{
+		Type:  "detokenize",
+		vault: v,
+	}}
+
+	replace.errors, err = json_error.NewHandler(config.errorPolicy, config.deadLetterPath)
+	if err != nil {
+		return nil, err
+	}
+	return replace, nil
+}
+
+// Open a vault, vaults with the same path are shared between rules
+func (replace *JSONReplace) openVault(path string, key string) (*Vault, error) {
+	v, found := replace.vaults[path]
+	if found {
+		if !v.matches(key) {
+			return nil, &json_error.ConfigError{Message: "Error: Vault '" + path + "' is used with different keys"}
+		}
+		return v, nil
+	}
+
+	v, err := OpenVault(path, key)
+	if err != nil {
+		return nil, &json_error.IOError{Path: path, Message: "Error: " + err.Error(), Err: err}
+	}
+	replace.vaults[path] = v
+	return v, nil
+}
+
+// Check if the input path exists, stdin always exists
+func checkInput(inputPath string) error {
+	if inputPath == json_compress.Stdio {
+		return nil
+	}
+	_, err := os.Stat(inputPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &json_error.IOError{Path: inputPath, Message: "Error: Input path '" + inputPath + "' not found", Err: err}
+		} else {
+			return &json_error.IOError{Path: inputPath, Message: "Error: Cannot read input path '" + inputPath + "'", Err: err}
+		}
+	}
+	return nil
+}
+
+// Return if the input is read before it is processed, by reproducible mode or by timestamp rules
+// of the preserve profile
+func scansInput(config *Config, rules []*Rule) bool {
+	for _, r := range rules {
+		if r.Type == "timestamp" && (config.reproducible || r.Profile == "preserve") {
+			return true
+		}
+	}
+	return false
 }
 
 // Execute
-func (replace *JSONReplace) Exec() {
+// Return the first error, records not in valid JSON format are handled by the error policy
+func (replace *JSONReplace) Exec() error {
+	// Nothing is processed in validate mode
+	if replace.config.validate {
+		log.Printf("Success: Rule file '%s' is valid\n", replace.config.rulePath)
+		return nil
+	}
+
 	// Record start time
 	startTime := time.Now()
 
 	// Initiate time for replay
 	for _, r := range replace.rules {
-		if r.StartMs == 0 {
-			r.replay.time = float64(time.Now().UnixMilli())
-		} else {
-			r.replay.time = float64(r.StartMs)
+		r.startReplay()
+	}
+	err := replace.scanOriginals()
+	if err != nil {
+		return err
+	}
+
+	// Plan the replay states of every file in reproducible mode
+	var plan map[string]map[*Rule]*Replay
+	if replace.config.reproducible {
+		plan, err = replace.planReplay()
+		if err != nil {
+			return err
 		}
-		r.replay.records = r.MaxRecords
 	}
 
-	// Limit the max number of goroutines running simultaneously
-	ch := make(chan int, replace.config.maxRoutines)
+	// Emit records to the replay target instead of output files in replay mode
+	if replace.config.replayTarget != "" && replace.report == nil {
+		replace.pacer, err = openPacer(replace.config.replayTarget, replace.config.replaySpeed, replace.pacingRule())
+		if err != nil {
+			return err
+		}
+	}
 
-	// Walk through and process the input file tree
-	err := filepath.WalkDir(replace.config.inputPath, func(path string, d fs.DirEntry, err error) error {
-		if !d.IsDir() {
-			// Assign the file and start a routine if the buffer is not full
-			replace.sync.assignCounter++
-			ch <- 1
-			go replace.startRoutine(path, ch)
+	// Record every change in the audit log, which is not written in dry-run mode
+	if replace.config.auditPath != "" && replace.report == nil {
+		replace.audit, err = openAudit(replace.config.auditPath, replace.config.auditSalt)
+		if err != nil {
+			return err
 		}
-		return err
+	}
+
+	// Write every file to stdout, unless records are emitted in replay mode or nothing is written in dry-run mode
+	if replace.config.outputPath == json_compress.Stdio && replace.pacer == nil && replace.report == nil {
+		replace.stdout, _ = json_compress.Create(json_compress.Stdio, replace.config.compress)
+	}
+
+	// Walk through and process the input file tree
+	err = replace.walk(func(path string) *fileState {
+		return &fileState{path: path, replays: plan[path]}
 	})
+	if replace.stdout != nil {
+		closeErr := replace.stdout.Close()
+		if closeErr != nil && err == nil {
+			err = &json_error.IOError{Path: json_compress.Stdio, Message: "Error: Cannot write to stdout", Err: closeErr}
+		}
+	}
+	if replace.pacer != nil {
+		closeErr := replace.pacer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if replace.audit != nil {
+		closeErr := replace.audit.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	// Save new tokens to vaults, even if a routine fails, so that every token written can be restored
+	// Vaults are not saved in dry-run mode, since no token is written
+	var saveErr error
+	for path, v := range replace.vaults {
+		if replace.report != nil {
+			break
+		}
+		err := v.Save()
+		if err != nil && saveErr == nil {
+			saveErr = &json_error.IOError{Path: path, Message: "Error: Cannot write to vault '" + path + "'", Err: err}
+		}
+	}
+	closeErr := replace.errors.Close()
+
+	// Return the error of processing before errors of saving and closing
 	if err != nil {
-		log.Fatal("Error: Failed to walk through the input directory")
+		return err
+	}
+	if saveErr != nil {
+		return saveErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	// Write the report instead of outputs in dry-run mode
+	if replace.report != nil {
+		err = replace.report.write(replace.config.reportPath, replace.sync.dropCounter)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Log output
+	log.Printf("Success: Processed %d file(s), dropped %d record(s) and skipped %d invalid record(s) in %.4f second(s)\n",
+		replace.sync.processCounter, replace.sync.dropCounter, replace.errors.Skipped(), time.Since(startTime).Seconds())
+	return nil
+}
+
+// Return the number of invalid records skipped or quarantined by the error policy
+func (replace *JSONReplace) Skipped() int {
+	return replace.errors.Skipped()
+}
+
+// Walk through the input file tree and process every file in a routine with the state created for it,
+// then wait until all files are processed
+// Return the first error of routines, or the error of walking
+func (replace *JSONReplace) walk(newState func(path string) *fileState) error {
+	// Limit the max number of goroutines running simultaneously
+	ch := make(chan int, replace.config.maxRoutines)
+
+	// Assign the file and start a routine if the buffer is not full
+	assign := func(path string) {
+		replace.sync.assignCounter++
+		ch <- 1
+		go replace.startRoutine(newState(path), ch)
+	}
+
+	// Stdin is processed as a single file
+	var walkErr error
+	if replace.config.inputPath == json_compress.Stdio {
+		assign(json_compress.Stdio)
+	} else {
+		walkErr = filepath.WalkDir(replace.config.inputPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Stop assigning files once a routine fails
+			if replace.sync.first.Get() != nil {
+				return errStopped
+			}
+			if !d.IsDir() {
+				assign(path)
+			}
+			return nil
+		})
 	}
 
 	// Wait until all files are processed
 	for replace.sync.assignCounter != replace.sync.processCounter {
 	}
 
-	// Log output
-	log.Printf("Success: Processed %d file(s) in %.4f second(s)\n",
-		replace.sync.processCounter, time.Since(startTime).Seconds())
+	if err := replace.sync.first.Get(); err != nil {
+		return err
+	}
+	if walkErr != nil && walkErr != errStopped {
+		return &json_error.IOError{Path: replace.config.inputPath, Message: "Error: Failed to walk through the input directory", Err: walkErr}
+	}
+	return nil
 }
 
 // Start a goroutine
-func (replace *JSONReplace) startRoutine(filePath string, ch chan int) {
-	replace.handleFile(filePath)
+func (replace *JSONReplace) startRoutine(state *fileState, ch chan int) {
+	replace.sync.first.Set(replace.handleFile(state))
 
 	// Lock the processCounter to ensure synchronization
 	replace.sync.lock.Lock()
@@ -208,11 +714,22 @@ func (replace *JSONReplace) startRoutine(filePath string, ch chan int) {
 }
 
 // Handle input json file
-func (replace *JSONReplace) handleFile(filePath string) {
+func (replace *JSONReplace) handleFile(state *fileState) error {
+	filePath := state.path
+
+	if replace.report != nil && !state.counting {
+		replace.report.count(1, 0, 0)
+	}
+
+	// Process the file incrementally in stream mode
+	if replace.config.stream {
+		return replace.handleStream(state)
+	}
+
 	// Read input file
-	input, err := os.ReadFile(filePath)
+	input, err := json_compress.ReadFile(filePath)
 	if err != nil {
-		log.Fatal("Error: Cannot read input file '" + filePath + "'")
+		return &json_error.IOError{Path: filePath, Message: "Error: Cannot read input file '" + filePath + "'", Err: err}
 	}
 
 	// Store the result
@@ -223,160 +740,670 @@ func (replace *JSONReplace) handleFile(filePath string) {
 	if replace.config.lineByLine {
 		inputs := bytes.Split(input, []byte("\n"))
 		for l, i := range inputs {
-			r, err := replace.handleJSON(i)
+			state.line = l + 1
+			r, dropped, err := replace.handleJSON(i, state)
 			if err != nil {
-				log.Fatal("Error: Line " + strconv.Itoa(l+1) + " of '" + filePath + "' is not in valid JSON format")
+				// Skip the line unless the error policy fails fast
+				err = replace.handleInvalid(state, &json_error.JSONError{File: filePath, Line: l + 1, Err: err}, i)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if dropped {
+				continue
+			}
+			if replace.pacer != nil && !state.counting && len(i) > 0 {
+				err = replace.emit(state, r)
+				if err != nil {
+					return err
+				}
+				continue
 			}
 			r = append(r, byte('\n'))
 			result = append(result, r...)
 		}
 	} else {
-		result, err = replace.handleJSON(input)
+		var dropped bool
+		result, dropped, err = replace.handleJSON(input, state)
 		if err != nil {
-			log.Fatal("Error: File '" + filePath + "' is not in valid JSON format")
+			// Skip the output file unless the error policy fails fast
+			line := json_error.Line(bytes.NewReader(input), err)
+			return replace.handleInvalid(state, &json_error.JSONError{File: filePath, Line: line, Err: err}, input)
+		}
+
+		// Skip the output file if the only record is dropped
+		if dropped {
+			return nil
+		}
+	}
+
+	// Nothing is written when the file is only counted, or in dry-run mode
+	if state.counting || replace.report != nil {
+		return nil
+	}
+
+	// Records are emitted instead of written in replay mode
+	if replace.pacer != nil {
+		if replace.config.lineByLine {
+			return nil
+		}
+		return replace.emit(state, result)
+	}
+
+	// Write to target file
+	target, err := replace.createTarget(filePath)
+	if err != nil {
+		return err
+	}
+	err = json_compress.WriteFile(target, result, replace.config.compress)
+	if err != nil {
+		return &json_error.IOError{Path: target, Message: "Error: Cannot write to '" + target + "'", Err: err}
+	}
+	return nil
+}
+
+// Emit a processed record in replay mode, paced at its replay time
+func (replace *JSONReplace) emit(state *fileState, record []byte) error {
+	return replace.pacer.emit(record, state.time, state.timed)
+}
+
+// Return the timestamp rule pacing records in replay mode, which is the first timestamp rule
+func (replace *JSONReplace) pacingRule() *Rule {
+	for _, r := range replace.rules {
+		if r.Type == "timestamp" {
+			return r
 		}
 	}
+	return nil
+}
+
+// Handle a record not in valid JSON format by the error policy
+// Invalid records are ignored when the file is only counted, since they are handled when the file is processed
+// Errors of rules and of writing, which are not caused by the record, are returned as they are
+func (replace *JSONReplace) handleInvalid(state *fileState, err *json_error.JSONError, record []byte) error {
+	var ioErr *json_error.IOError
+	if errors.As(err.Err, &ioErr) {
+		return err.Err
+	}
+	if state.counting {
+		return nil
+	}
+	if replace.report != nil {
+		replace.report.count(0, 0, 1)
+	}
+	return replace.errors.Handle(err, record)
+}
 
-	// Get target output path
-	target := strings.Replace(filePath, replace.config.inputPath, replace.config.outputPath, 1)
+// Get target output path of an input file, and create its parent directory
+func (replace *JSONReplace) createTarget(filePath string) (string, error) {
+	// Get target output path, an output file given explicitly is written as it is, and an output derived
+	// from a file in the input directory takes the extension of compression if outputs are compressed
+	target := replace.config.outputPath
+	if filePath != replace.config.inputPath {
+		target = strings.Replace(filePath, replace.config.inputPath, replace.config.outputPath, 1)
+		target = json_compress.Target(target, replace.config.compress)
+	}
 
 	// Get parent directory of the target
 	dir, _ := filepath.Split(target)
 
 	// Create the directory if the file is not in root
 	if dir != "" {
-		err = os.MkdirAll(dir, 0700)
+		err := os.MkdirAll(dir, 0700)
 		if err != nil {
-			log.Fatal("Error: Failed to create directory '" + dir + "'")
+			return "", &json_error.IOError{Path: dir, Message: "Error: Failed to create directory '" + dir + "'", Err: err}
 		}
 	}
-
-	// Write to target file
-	err = os.WriteFile(target, result, 0666)
-	if err != nil {
-		log.Fatal("Error: Cannot write to '" + target + "'")
-	}
+	return target, nil
 }
 
 // Handle a single JSON object
-func (replace *JSONReplace) handleJSON(input []byte) ([]byte, error) {
+// Return if the record is dropped by a drop-record rule
+func (replace *JSONReplace) handleJSON(input []byte, state *fileState) ([]byte, bool, error) {
 	// Return if the input is empty
 	if len(input) == 0 {
-		return nil, nil
+		return nil, false, nil
 	}
 
 	// Parse input file
-	var m interface{}
-	err := json.Unmarshal(input, &m)
+	m, err := replace.decode(input)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	// Apply every rule on files
-	for _, r := range replace.rules {
+	// Apply every rule on the record
+	m, dropped, err := replace.handleValue(nil, m, state)
+	if err != nil {
+		return nil, false, err
+	}
+	if dropped {
+		return nil, true, nil
+	}
+
+	// Write file to output
+	return replace.encode(m, input), false, nil
+}
+
+// Apply every rule on a parsed value located at the prefix of keys and indices in the record
+// The prefix is empty unless the value is a part of a record in stream mode
+// Return the result, and if the value is dropped by a drop-record rule
+// Return an error if a rule fails, such as a tokenize rule that cannot generate a token
+func (replace *JSONReplace) handleValue(prefix []interface{}, m interface{}, state *fileState) (interface{}, bool, error) {
+	// Elements of the arrays of a record share the replay time of the rest of the record
+	within := state.records != nil && !state.recording
+	if !within {
+		state.timed = false
+	}
+	reporting := replace.report != nil && !state.counting
+	if reporting {
+		replace.report.count(0, 1, 0)
+	}
+	auditing := replace.audit != nil && !state.counting
+	rules := replace.rules
+	if state.counting {
+		rules = replace.countRules
+	}
+	for i, r := range rules {
+		var record interface{}
+		if state.recording {
+			state.records = append(state.records, copyValue(m))
+		} else if within {
+			record = state.records[i]
+		}
+
+		// Skip the rule if the record does not meet its conditions
+		if !json_condition.MatchAllWithin(r.When, record, prefix, m) {
+			continue
+		}
+
+		// Keep the value before the rule to report the impact of the rule in dry-run mode,
+		// and collect the changes of the rule to report them or to record them in the audit log
+		var before interface{}
+		if reporting {
+			before = copyValue(m)
+		}
+		var log *changeLog
+		if reporting || auditing {
+			log = &changeLog{}
+		}
+
+		var err error
 		switch r.Type {
-		case "per-field":
-			replace.process("", m, *r)
-		case "global":
-			replace.process("", m, *r)
+		case "drop-record":
+			if r.matchRecord(prefix, m) {
+				if reporting {
+					replace.report.add(r, state, prefix, before, nil, nil, true)
+				}
+				if auditing {
+					replace.audit.record(r, state, prefix, m, nil, true)
+				}
+				if !state.counting {
+					replace.sync.lock.Lock()
+					replace.sync.dropCounter++
+					replace.sync.lock.Unlock()
+				}
+				return nil, true, nil
+			}
 		case "timestamp":
-			replace.processReplay("", m, r)
+			// Timestamp fields are added to the record if missing
+			root := m
+			m = r.path.PutLocated(prefix, m, func(location []interface{}, v interface{}) interface{} {
+				if log != nil {
+					if exists(root, location[len(prefix):]) {
+						log.add(location, v, actionReplace)
+					} else {
+						log.add(location, nil, actionAdd)
+					}
+				}
+				return r.formatTimestamp(replace.nextReplayTime(r, v, state), v)
+			})
+		case "key-name":
+			replace.processKeys(prefix, m, r, log)
+		case "date-shift":
+			// Shift all dates of the record by the offset of its entity
+			entity, _ := r.findEntity(record, prefix, m)
+			rule := *r
+			rule.offset = r.entityOffset(entity)
+			m, err = replace.processField(prefix, m, &rule, log)
+		case "fake":
+			// Fake values of the same entity belong to the same fake identity
+			rule := *r
+			if entity, found := r.findEntity(record, prefix, m); found {
+				rule.identity = entityData(entity)
+			}
+			m, err = replace.processField(prefix, m, &rule, log)
 		default:
-			log.Fatal("Error: Invalid type '" + r.Type + "'")
+			if r.isGlobal() {
+				err = replace.process(prefix, m, r, log)
+			} else {
+				m, err = replace.processField(prefix, m, r, log)
+			}
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		if reporting {
+			replace.report.add(r, state, prefix, before, m, log, false)
+		}
+		if auditing {
+			replace.audit.record(r, state, prefix, m, log, false)
 		}
 	}
+	return m, false, nil
+}
 
-	// Write file to output
-	result, _ := json.Marshal(m)
-	return result, nil
+// Return the first value of the entity of the rule in the record,
+// which is also looked up in the rest of the record if the value is an element of its arrays
+func (r *Rule) findEntity(record interface{}, prefix []interface{}, m interface{}) (interface{}, bool) {
+	if r.entity == nil {
+		return nil, false
+	}
+	found := r.entity.FindAt(prefix, m)
+	if record != nil {
+		found = append(found, r.entity.Find(record)...)
+	}
+	if len(found) == 0 {
+		return nil, false
+	}
+	return found[0], true
 }
 
-// Process non-string elements
-func (replace *JSONReplace) process(k string, v interface{}, r Rule) {
+// Process every value selected by the field name of the rule
+// Values after the first error are left as they are
+func (replace *JSONReplace) processField(prefix []interface{}, v interface{}, r *Rule, log *changeLog) (interface{}, error) {
+	var err error
+	v = r.path.ApplyLocated(prefix, v, func(location []interface{}, v interface{}) interface{} {
+		if err != nil {
+			return v
+		}
+		var result interface{}
+		result, err = replace.applyField(location, v, r, log)
+		if err != nil {
+			return v
+		}
+		return result
+	})
+	return v, err
+}
+
+// Apply the rule on a value selected by the field name at the location
+// Remove and set rules apply on the whole value, other rules apply on every element of an array
+func (replace *JSONReplace) applyField(location []interface{}, v interface{}, r *Rule, log *changeLog) (interface{}, error) {
+	switch r.Type {
+	case "remove":
+		return r.remove(location, v, log), nil
+	case "set":
+		return r.applyValue(location, v, log)
+	}
+
 	switch v.(type) {
 	case map[string]interface{}:
-		replace.processMap(v.(map[string]interface{}), r)
+		return v, nil
 	case []interface{}:
-		replace.processArray(v.([]interface{}), k, r)
+		a := v.([]interface{})
+		for i, e := range a {
+			result, err := replace.applyField(log.step(location, i), e, r, log)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = result
+		}
+		return a, nil
 	}
+	return r.applyValue(location, v, log)
 }
 
-// Process maps
-func (replace *JSONReplace) processMap(m map[string]interface{}, r Rule) {
-	// If global rule applies, iterate every element in the map
-	// If not, check if the particular field exists
-	if r.Type == "global" {
-		for k, v := range m {
-			switch v.(type) {
-			case string:
-				m[k] = strings.Replace(v.(string), r.Original, r.Replacement, -1)
-			default:
-				replace.process(k, v, r)
-			}
+// Process non-string elements of global rules
+func (replace *JSONReplace) process(location []interface{}, v interface{}, r *Rule, log *changeLog) error {
+	switch v.(type) {
+	case map[string]interface{}:
+		return replace.processMap(location, v.(map[string]interface{}), r, log)
+	case []interface{}:
+		return replace.processArray(location, v.([]interface{}), r, log)
+	}
+	return nil
+}
+
+// Process maps, iterate every element in the map
+func (replace *JSONReplace) processMap(location []interface{}, m map[string]interface{}, r *Rule, log *changeLog) error {
+	for k, v := range m {
+		var err error
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			err = replace.process(log.step(location, k), v, r, log)
+		default:
+			m[k], err = r.applyValue(log.step(location, k), v, log)
 		}
-	} else {
-		k, next, _ := strings.Cut(r.FieldName, ".")
-		v, found := m[k]
-		if found {
-			switch v.(type) {
-			case string:
-				if next == "" {
-					m[k] = strings.Replace(v.(string), r.Original, r.Replacement, -1)
-				}
-			default:
-				r.FieldName = next
-				replace.process(k, v, r)
-			}
+		if err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-// Process arrays
-func (replace *JSONReplace) processArray(a []interface{}, k string, r Rule) {
+// Process arrays, iterate every element in the array
+func (replace *JSONReplace) processArray(location []interface{}, a []interface{}, r *Rule, log *changeLog) error {
 	for i, v := range a {
+		var err error
 		switch v.(type) {
-		case string:
-			if k == "" {
-				a[i] = strings.Replace(v.(string), r.Original, r.FieldName, -1)
+		case map[string]interface{}, []interface{}:
+			err = replace.process(log.step(location, i), v, r, log)
+		default:
+			a[i], err = r.applyValue(log.step(location, i), v, log)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the rule on a value at the location, and record the value if the rule replaces it
+// Set rules replace every value they match, even with an equal value,
+// and other rules replace the values they change
+// Return an error if a tokenize rule cannot generate a token
+func (r *Rule) applyValue(location []interface{}, v interface{}, log *changeLog) (interface{}, error) {
+	var result interface{}
+	switch r.Type {
+	case "set":
+		if !r.matchSet(v) {
+			return v, nil
+		}
+		log.add(location, v, actionReplace)
+		return r.newValue(), nil
+	case "tokenize":
+		token, err := r.vault.tokenize(v, r.Replacement)
+		if err != nil {
+			return v, &json_error.IOError{Path: r.Vault, Message: "Error: Cannot generate a token for vault '" + r.Vault + "'", Err: err}
+		}
+		result = token
+	default:
+		result = r.apply(v)
+	}
+	if result != v {
+		log.add(location, v, actionReplace)
+	}
+	return result, nil
+}
+
+// Types of rules, and whether each must specify field-name
+var ruleTypes = map[string]bool{
+	"global":        false,
+	"per-field":     true,
+	"timestamp":     true,
+	"regex":         false,
+	"hash":          true,
+	"remove":        true,
+	"drop-record":   true,
+	"noise":         true,
+	"round":         true,
+	"clamp":         true,
+	"bucket":        true,
+	"date-truncate": true,
+	"date-shift":    true,
+	"fake":          true,
+	"ip":            false,
+	"set":           true,
+	"key-name":      false,
+	"tokenize":      true,
+	"detect":        false,
+}
+
+// Check the rule and compile its patterns, and return the first problem
+func (r *Rule) prepare() error {
+	var err error
+	r.check(func(message string, location ...interface{}) {
+		if err == nil {
+			err = &json_error.RuleError{Rule: r.Order, Message: "Error: " + message + " in rule " + strconv.Itoa(r.Order)}
+		}
+	})
+	return err
+}
+
+// Check the rule and compile its patterns
+// Every problem is reported with its location in the rule, which is a key of the rule followed by keys or indexes
+// of the value of the key, or nothing if the problem is about the whole rule
+func (r *Rule) check(report func(message string, location ...interface{})) {
+	var err error
+
+	needsField, found := ruleTypes[r.Type]
+	if r.Type == "" {
+		report("Missing type", "type")
+		return
+	}
+	if !found {
+		report("Invalid type '"+r.Type+"'", "type")
+		return
+	}
+
+	// Parse the field name, which is ignored by global rules
+	if r.FieldName == "" && needsField {
+		report("Rule of type '"+r.Type+"' must specify field-name", "field-name")
+	}
+	if r.FieldName != "" {
+		r.path, err = json_path.Parse(r.FieldName)
+		if err != nil {
+			report(err.Error(), "field-name")
+		}
+	}
+
+	// Prepare the conditions of the when block
+	for i, c := range r.When {
+		err = c.Prepare()
+		if err != nil {
+			report(err.Error(), "when", i)
+		}
+	}
+
+	switch r.Type {
+	case "timestamp":
+		if r.MaxRecords <= 0 {
+			report("Timestamp rule must specify a positive max-records", "max-records")
+		}
+		if r.Duration < 0 {
+			report("Duration must not be negative", "duration")
+		}
+		err = r.prepareTimestamp()
+		if err != nil {
+			report(err.Error())
+		}
+		err = r.prepareProfile()
+		if err != nil {
+			report(err.Error())
+		}
+	case "regex":
+		r.pattern, err = regexp.Compile(r.Original)
+		if err != nil {
+			report("Invalid regex pattern '"+r.Original+"'", "original")
+		}
+	case "hash":
+		if r.Key == "" {
+			report("Hash rule must specify key", "key")
+		}
+	case "noise":
+		if r.Noise <= 0 {
+			report("Noise rule must specify a positive noise", "noise")
+		}
+		r.noise = newNoise(r.Seed)
+	case "round":
+		if r.Step <= 0 && r.Digits <= 0 {
+			report("Round rule must specify a positive step or digits", "step")
+		}
+	case "clamp":
+		if r.Min == nil && r.Max == nil {
+			report("Clamp rule must specify min or max")
+		}
+	case "bucket":
+		if r.Step <= 0 && len(r.Buckets) == 0 {
+			report("Bucket rule must specify buckets or a positive step", "buckets")
+		}
+	case "date-truncate":
+		if r.Unit != "hour" && r.Unit != "day" && r.Unit != "month" && r.Unit != "year" {
+			report("Date-truncate rule must specify unit of hour, day, month or year", "unit")
+		}
+	case "date-shift":
+		if r.Entity == "" {
+			report("Date-shift rule must specify entity", "entity")
+		}
+		if r.Key == "" {
+			report("Date-shift rule must specify key", "key")
+		}
+		if r.MaxDays <= 0 {
+			report("Date-shift rule must specify a positive max-days", "max-days")
+		}
+	case "fake":
+		if fakers[r.Kind] == nil {
+			report("Fake rule must specify kind of "+fakeKinds(), "kind")
+		}
+	case "ip":
+		switch r.Mode {
+		case "truncate":
+			if r.Bits < 0 || r.Bits > 32 {
+				report("IP rule must specify bits within 0-32", "bits")
+			}
+			if r.BitsV6 < 0 || r.BitsV6 > 128 {
+				report("IP rule must specify bits-v6 within 0-128", "bits-v6")
+			}
+		case "prefix-preserving":
+			if r.Key == "" {
+				report("IP rule must specify key in prefix-preserving mode", "key")
 			}
+			r.cryptoPAn = newCryptoPAn(r.Key)
 		default:
-			replace.process(k, v, r)
+			report("IP rule must specify mode of truncate or prefix-preserving", "mode")
+		}
+	case "set":
+		if r.Value == nil {
+			report("Set rule must specify value", "value")
+		}
+		// Encode match in the same form as the values it is compared with
+		if r.Match != nil {
+			var match interface{}
+			_ = json.Unmarshal(r.Match, &match)
+			r.match, _ = json.Marshal(match)
+		}
+	case "key-name":
+		if len(r.Keys) == 0 && r.KeyRegex == "" {
+			report("Key-name rule must specify keys or key-regex", "keys")
+		}
+		if r.Action != "" && r.Action != "replace" && r.Action != "remove" {
+			report("Key-name rule must specify action of replace or remove", "action")
+		}
+		r.keyPattern, err = compileKeyPattern(r.Keys, r.KeyRegex)
+		if err != nil {
+			report("Invalid key-regex '"+r.KeyRegex+"'", "key-regex")
+		}
+	case "tokenize":
+		if r.Vault == "" {
+			report("Tokenize rule must specify vault", "vault")
+		}
+		if r.Key == "" {
+			report("Tokenize rule must specify key", "key")
+		}
+	case "detect":
+		for name := range r.Detectors {
+			if builtinDetector(name) == nil {
+				report("Unknown detector '"+name+"'", "detectors", name)
+			}
+		}
+		r.detectors = newDetectors(r.Detectors)
+	}
+
+	// Entities are only used by date-shift and fake rules
+	if r.Entity != "" && (r.Type == "date-shift" || r.Type == "fake") {
+		r.entity, err = json_path.Parse(r.Entity)
+		if err != nil {
+			report(err.Error(), "entity")
 		}
 	}
 }
 
-// Process replay
-func (replace *JSONReplace) processReplay(k string, v interface{}, r *Rule) {
-	switch v.(type) {
-	case map[string]interface{}:
-		replace.processReplayMap(v.(map[string]interface{}), r)
-	case []interface{}:
-		replace.processReplayArray(v.([]interface{}), k, r)
+// Return if the rule applies to every field
+// A regex, detect or ip rule without a field name is applied globally
+func (r *Rule) isGlobal() bool {
+	switch r.Type {
+	case "global":
+		return true
+	case "regex", "detect", "ip":
+		return r.FieldName == ""
+	case "detokenize":
+		return true
 	}
+	return false
 }
 
-// Process replay maps
-func (replace *JSONReplace) processReplayMap(m map[string]interface{}, r *Rule) {
-	k, next, _ := strings.Cut(r.FieldName, ".")
-	if next == "" {
+// Apply the rule on a single value and return the result
+// Non-string values are only changed by hash, detokenize, numeric, set, date and fake rules,
+// and tokenize rules are applied by applyValue since they can fail
+func (r *Rule) apply(v interface{}) interface{} {
+	switch r.Type {
+	case "hash":
+		return r.hash(v)
+	case "detokenize":
+		return r.vault.detokenize(v)
+	case "noise", "round", "clamp", "bucket":
+		return r.transformNumber(v)
+	case "set":
+		return r.set(v)
+	case "date-truncate":
+		return r.truncateDate(v)
+	case "date-shift":
+		return r.shiftDate(v)
+	case "fake":
+		return r.fake(v)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	switch r.Type {
+	case "regex":
+		// Regex rules expand capture groups such as $1 in the replacement
+		return r.pattern.ReplaceAllString(s, r.Replacement)
+	case "detect":
+		return r.detect(s)
+	case "ip":
+		// Global ip rules anonymize every address found in the string
+		if r.FieldName == "" {
+			return r.anonymizeIPs(s)
+		}
+		return r.anonymizeIP(s)
+	}
+	return strings.Replace(s, r.Original, r.Replacement, -1)
+}
+
+// Return the next replay time of a timestamp rule, the original value is used by the preserve profile
+// In reproducible mode, every file has its own replay states, which are not shared between routines
+func (replace *JSONReplace) nextReplayTime(r *Rule, original interface{}, state *fileState) int64 {
+	replay := &r.replay
+	if state.replays != nil {
+		replay = state.replays[r]
+		if state.counting {
+			replay.index++
+			return 0
+		}
+	} else {
 		replace.sync.lock.Lock()
 		defer replace.sync.lock.Unlock()
-		cur := r.replay.time + replace.calculateIncrement(r.replay.index, r.Duration, r.replay.records)
-		m[k] = int64(cur)
-		r.replay.time = cur
-		r.replay.index++
+	}
+
+	var cur float64
+	if r.Profile == "preserve" {
+		cur = replay.preserveTime(original)
 	} else {
-		for k, v := range m {
-			replace.processReplay(k, v, r)
-		}
+		cur = replay.time + replace.nextIncrement(r, replay)
 	}
-}
+	replay.time = cur
+	replay.index++
 
-// Process replay arrays
-func (replace *JSONReplace) processReplayArray(a []interface{}, k string, r *Rule) {
-	for _, v := range a {
-		replace.processReplay(k, v, r)
+	// Record the replay time of the record to pace it in replay mode
+	if replace.pacer != nil && r == replace.pacer.rule {
+		state.time = int64(cur)
+		state.timed = true
 	}
+	return int64(cur)
 }
 
 // Calculate the increment of a record by integration
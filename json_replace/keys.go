@@ -0,0 +1,66 @@
+package json_replace
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Compile the glob patterns and the regex of key names into a single pattern
+// Glob patterns are case-insensitive, and support * for any characters and ? for a single character
+func compileKeyPattern(globs []string, keyRegex string) (*regexp.Regexp, error) {
+	var alternatives []string
+	for _, glob := range globs {
+		var b strings.Builder
+		b.WriteString("(?i:^")
+		for _, c := range glob {
+			switch c {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		b.WriteString("$)")
+		alternatives = append(alternatives, b.String())
+	}
+	if keyRegex != "" {
+		_, err := regexp.Compile(keyRegex)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, "(?:"+keyRegex+")")
+	}
+	return regexp.Compile(strings.Join(alternatives, "|"))
+}
+
+// Walk through the whole value, and replace or remove every field whose key name matches the rule
+// Matched values are replaced regardless of their types and are not walked into
+func (replace *JSONReplace) processKeys(location []interface{}, v interface{}, r *Rule, log *changeLog) {
+	switch v.(type) {
+	case map[string]interface{}:
+		m := v.(map[string]interface{})
+		for k, child := range m {
+			if !r.keyPattern.MatchString(k) {
+				replace.processKeys(log.step(location, k), child, r, log)
+				continue
+			}
+			if r.Action == "remove" {
+				log.add(log.step(location, k), child, actionRemove)
+				delete(m, k)
+				continue
+			}
+			log.add(log.step(location, k), child, actionReplace)
+			if r.Value != nil {
+				m[k] = r.newValue()
+			} else {
+				m[k] = r.Replacement
+			}
+		}
+	case []interface{}:
+		for i, child := range v.([]interface{}) {
+			replace.processKeys(log.step(location, i), child, r, log)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package json_replace
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bucket struct represents a range of numbers and its label
+// A missing bound is unbounded, the range includes min and excludes max
+type Bucket struct {
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+	Label string   `json:"label"`
+}
+
+// Noise struct derives the noise of each value from a seed, so that it does not depend on the order
+// in which records and files are processed by routines
+type Noise struct {
+	key []byte
+}
+
+// Create a noise generator, a zero seed uses the current time
+func newNoise(seed int64) *Noise {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(seed))
+	return &Noise{key: key}
+}
+
+// Return a number in [-bound, bound] derived from the field name and the literal of a value by HMAC of the seed,
+// so that the same value of the same field has the same noise in every record and file
+func (n *Noise) next(field string, literal string, bound float64) float64 {
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(literal))
+	// The top 53 bits are a uniform float64 in [0, 1)
+	u := float64(binary.BigEndian.Uint64(mac.Sum(nil))>>11) / (1 << 53)
+	return (u*2 - 1) * bound
+}
+
+// Transform a number by the numeric rule, non-number values are returned untouched
+func (r *Rule) transformNumber(v interface{}) interface{} {
+	f, ok := toFloat(v)
+	if !ok {
+		return v
+	}
+
+	switch r.Type {
+	case "noise":
+		literal, _ := numberLiteral(v)
+		result := f + r.noise.next(r.FieldName, literal, r.Noise)
+		// Keep whole numbers whole if the bound is whole
+		if f == math.Trunc(f) && r.Noise == math.Trunc(r.Noise) {
+			result = math.Round(result)
+		}
+		return result
+	case "round":
+		result := roundDigits(f, r.Digits)
+		if r.Step > 0 {
+			result = roundStep(f, r.Step)
+		}
+		if result != f {
+			return result
+		}
+	case "clamp":
+		if r.Min != nil && f < *r.Min {
+			return *r.Min
+		}
+		if r.Max != nil && f > *r.Max {
+			return *r.Max
+		}
+	case "bucket":
+		if result := r.bucket(f); result != f {
+			return result
+		}
+	}
+	// Numbers unchanged are returned untouched so that their literals are kept in faithful mode
+	return v
+}
+
+// Return the value of a number, which is a float64 or a json.Number decoded in faithful mode
+func toFloat(v interface{}) (float64, bool) {
+	switch v.(type) {
+	case float64:
+		return v.(float64), true
+	case json.Number:
+		f, err := v.(json.Number).Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Return the canonical literal of a number, which is the integer itself for integers of any size,
+// or the shortest representation of its float64 value otherwise
+// Equal numbers in different representations, such as 42 and 4.2e1, share a literal,
+// while distinct integers beyond the precision of float64 decoded in faithful mode do not
+func numberLiteral(v interface{}) (string, bool) {
+	if n, ok := v.(json.Number); ok {
+		if i, ok := new(big.Int).SetString(string(n), 10); ok {
+			return i.String(), true
+		}
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return "", false
+	}
+	literal, _ := json.Marshal(f)
+	return string(literal), true
+}
+
+// Round a number to the nearest multiple of the step
+func roundStep(f float64, step float64) float64 {
+	result := math.Round(f/step) * step
+
+	// Remove floating point errors by the number of decimals of the step
+	decimals := 0
+	s := strconv.FormatFloat(step, 'f', -1, 64)
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		decimals = len(s) - i - 1
+	}
+	result, _ = strconv.ParseFloat(strconv.FormatFloat(result, 'f', decimals, 64), 64)
+	return result
+}
+
+// Round a number to the number of significant digits
+func roundDigits(f float64, digits int) float64 {
+	if f == 0 || digits <= 0 {
+		return f
+	}
+	result, _ := strconv.ParseFloat(strconv.FormatFloat(f, 'g', digits, 64), 64)
+	return result
+}
+
+// Return the label of the bucket containing the number
+// Buckets of width step are generated if no bucket is specified
+// The replacement is returned if no bucket contains the number, or the number if the replacement is empty
+func (r *Rule) bucket(f float64) interface{} {
+	if len(r.Buckets) == 0 {
+		if r.Step <= 0 {
+			return f
+		}
+		low := math.Floor(f/r.Step) * r.Step
+		high := low + r.Step
+		// Show inclusive bounds for whole numbers, such as 30-39
+		if r.Step == math.Trunc(r.Step) && f == math.Trunc(f) {
+			high--
+		}
+		return strconv.FormatFloat(low, 'f', -1, 64) + "-" + strconv.FormatFloat(high, 'f', -1, 64)
+	}
+
+	for _, b := range r.Buckets {
+		if (b.Min == nil || f >= *b.Min) && (b.Max == nil || f < *b.Max) {
+			return b.Label
+		}
+	}
+	if r.Replacement != "" {
+		return r.Replacement
+	}
+	return f
+}
+
+// Replace a value of any type with the value of the set rule
+// If match is specified, only a value equal to match is replaced
+func (r *Rule) set(v interface{}) interface{} {
+	// Numbers not matched are returned untouched so that their literals are kept in faithful mode
+	if !r.matchSet(v) {
+		return v
+	}
+	return r.newValue()
+}
+
+// Return if a set rule replaces the value, which is every value unless the rule specifies one to match
+// Numbers are compared by value
+func (r *Rule) matchSet(v interface{}) bool {
+	if r.Match == nil {
+		return true
+	}
+	if f, ok := toFloat(v); ok {
+		v = f
+	}
+	encoded, _ := json.Marshal(v)
+	return bytes.Equal(encoded, r.match)
+}
+
+// Decode the value of the rule
+// A new copy is decoded every time so that records never share a map or an array
+func (r *Rule) newValue() interface{} {
+	var v interface{}
+	_ = json.Unmarshal(r.Value, &v)
+	return v
+}
@@ -0,0 +1,92 @@
+package json_replace
+
+import (
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pacer struct emits records to the replay target, each no earlier than its replay time
+type Pacer struct {
+	// Target of records, which is stdout, a file being appended to, or a TCP or UDP socket
+	target string
+	writer io.Writer
+	closer io.Closer
+
+	// Timestamp rule whose replay times pace the records
+	rule *Rule
+
+	// Speed multiplier, 2 replays twice as fast as the replay times
+	speed float64
+
+	// Wall clock time when the replay starts, which corresponds to the start time of the rule
+	origin time.Time
+
+	// Lock for writing a record at a time
+	lock sync.Mutex
+}
+
+// Open the replay target
+// The target is - for stdout, tcp://host:port or udp://host:port for a socket, or a path to a file
+func openPacer(target string, speed float64, rule *Rule) (*Pacer, error) {
+	p := &Pacer{target: target, rule: rule, speed: speed}
+
+	switch {
+	case target == "-":
+		p.writer = os.Stdout
+	case strings.HasPrefix(target, "tcp://"), strings.HasPrefix(target, "udp://"):
+		conn, err := net.Dial(target[:3], target[6:])
+		if err != nil {
+			return nil, &json_error.IOError{Path: target, Message: "Error: Cannot connect to '" + target + "'", Err: err}
+		}
+		p.writer = conn
+		p.closer = conn
+	default:
+		f, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			return nil, &json_error.IOError{Path: target, Message: "Error: Failed to open or create file '" + target + "'", Err: err}
+		}
+		p.writer = f
+		p.closer = f
+	}
+
+	p.origin = time.Now()
+	return p, nil
+}
+
+// Wait until the replay time of a record is due, then write the record in a line
+// A record without a replay time is written immediately
+func (p *Pacer) emit(record []byte, ms int64, timed bool) error {
+	if timed {
+		elapsed := (float64(ms) - p.rule.replay.start) / p.speed
+		time.Sleep(time.Until(p.origin.Add(time.Duration(elapsed * float64(time.Millisecond)))))
+	}
+
+	// Every record is written at once, which is a single datagram for UDP
+	line := make([]byte, 0, len(record)+1)
+	line = append(append(line, record...), '\n')
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, err := p.writer.Write(line)
+	if err != nil {
+		return &json_error.IOError{Path: p.target, Message: "Error: Cannot write to '" + p.target + "'", Err: err}
+	}
+	return nil
+}
+
+// Close the replay target
+func (p *Pacer) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	err := p.closer.Close()
+	if err != nil {
+		return &json_error.IOError{Path: p.target, Message: "Error: Failed to close '" + p.target + "'", Err: err}
+	}
+	return nil
+}
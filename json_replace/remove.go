@@ -0,0 +1,66 @@
+package json_replace
+
+import "github.com/Joker-Jane/JSON-replacement/json_path"
+
+// Remove a value selected by the field name at the location, and record the removed values
+// If the original is specified, only a value equal to the original is removed,
+// and only elements equal to the original are removed from an array
+func (r *Rule) remove(location []interface{}, v interface{}, log *changeLog) interface{} {
+	if r.Original == "" {
+		log.add(location, v, actionRemove)
+		return json_path.Delete
+	}
+
+	switch v.(type) {
+	case []interface{}:
+		kept := []interface{}{}
+		for i, e := range v.([]interface{}) {
+			if r.equal(e) {
+				log.add(log.step(location, i), e, actionRemove)
+			} else {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	default:
+		if r.equal(v) {
+			log.add(location, v, actionRemove)
+			return json_path.Delete
+		}
+	}
+	return v
+}
+
+// Return if the field of the rule is found in the record
+// If the original is specified, the field must also be equal to the original
+func (r *Rule) matchRecord(prefix []interface{}, v interface{}) bool {
+	for _, found := range r.path.FindAt(prefix, v) {
+		if r.matchValue(found) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return if the value of a found field matches the rule
+// An array matches if any of its elements is equal to the original
+func (r *Rule) matchValue(v interface{}) bool {
+	if r.Original == "" {
+		return true
+	}
+	if a, ok := v.([]interface{}); ok {
+		for _, e := range a {
+			if r.equal(e) {
+				return true
+			}
+		}
+		return false
+	}
+	return r.equal(v)
+}
+
+// Return if a string value is equal to the original
+func (r *Rule) equal(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && s == r.Original
+}
@@ -0,0 +1,314 @@
+package json_replace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_condition"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Default settings of replay profiles
+const (
+	defaultBurstSize = 10
+	defaultPeakHour  = 14
+	defaultAmplitude = 0.8
+)
+
+// Check the replay profile of a timestamp rule
+func (r *Rule) prepareProfile() error {
+	switch r.Profile {
+	case "", "uniform", "preserve":
+	case "poisson", "bursty", "diurnal":
+		if r.BurstSize < 0 {
+			return errors.New("Burst-size must not be negative")
+		}
+		if r.PeakHour != nil && (*r.PeakHour < 0 || *r.PeakHour > 23) {
+			return errors.New("Peak-hour must be within 0-23")
+		}
+		if r.Amplitude < 0 || r.Amplitude >= 1 {
+			return errors.New("Amplitude must be within [0, 1)")
+		}
+	default:
+		return errors.New("Invalid profile '" + r.Profile + "'")
+	}
+	return nil
+}
+
+// Initiate the replay state of a timestamp rule
+func (r *Rule) startReplay() {
+	if r.StartMs == 0 {
+		r.replay.time = float64(time.Now().UnixMilli())
+	} else {
+		r.replay.time = float64(r.StartMs)
+	}
+	r.replay.start = r.replay.time
+	r.replay.records = r.MaxRecords
+	r.replay.index = 0
+
+	// A zero seed uses the current time
+	seed := r.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	r.replay.random = rand.New(rand.NewSource(seed))
+}
+
+// Return the increment of the next record by the profile of the rule
+// Every profile spreads the records over the duration on average
+func (replace *JSONReplace) nextIncrement(r *Rule, replay *Replay) float64 {
+	mean := float64(r.Duration) / float64(replay.records)
+
+	switch r.Profile {
+	case "poisson":
+		// Exponential gaps between arrivals
+		return replay.random.ExpFloat64() * mean
+	case "bursty":
+		// Records arrive in bursts of short gaps, separated by long idle gaps
+		size := int64(r.BurstSize)
+		if size == 0 {
+			size = defaultBurstSize
+		}
+		short := mean / float64(size)
+		if replay.index%size != 0 {
+			return replay.random.ExpFloat64() * short
+		}
+		return replay.random.ExpFloat64() * (float64(size)*mean - float64(size-1)*short)
+	case "diurnal":
+		// Arrivals are more frequent around the peak hour and less frequent around the opposite hour
+		peak := float64(defaultPeakHour)
+		if r.PeakHour != nil {
+			peak = float64(*r.PeakHour)
+		}
+		amplitude := r.Amplitude
+		if amplitude == 0 {
+			amplitude = defaultAmplitude
+		}
+		t := time.UnixMilli(int64(replay.time)).In(r.location)
+		hour := float64(t.Hour()) + float64(t.Minute())/60
+		weight := 1 + amplitude*math.Cos(2*math.Pi*(hour-peak)/24)
+		return replay.random.ExpFloat64() * mean / weight
+	}
+	return replace.calculateIncrement(replay.index, r.Duration, replay.records)
+}
+
+// Return the replay time of a record by its original timestamp in the preserve profile
+// The original gaps are scaled so that the earliest and latest originals span the duration
+// A record without a valid original timestamp gets the time of the previous record
+func (replay *Replay) preserveTime(original interface{}) float64 {
+	t, ok := parseTimestamp(original)
+	if !ok {
+		return replay.time
+	}
+	offset := float64(t.UnixNano())/float64(time.Millisecond) - replay.first
+	return replay.start + offset*replay.scale
+}
+
+// Find the earliest and latest original timestamps of every rule in the preserve profile,
+// which requires reading the input once before processing
+// Records not in valid JSON format are ignored here, and handled by the error policy later
+func (replace *JSONReplace) scanOriginals() error {
+	var rules []*Rule
+	for _, r := range replace.rules {
+		if r.Type == "timestamp" && r.Profile == "preserve" {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	first := make([]float64, len(rules))
+	last := make([]float64, len(rules))
+	seen := make([]bool, len(rules))
+	observe := func(record interface{}, prefix []interface{}, v interface{}) {
+		for i, r := range rules {
+			if !json_condition.MatchAllWithin(r.When, record, prefix, v) {
+				continue
+			}
+			for _, found := range r.path.FindAt(prefix, v) {
+				t, ok := parseTimestamp(found)
+				if !ok {
+					continue
+				}
+				ms := float64(t.UnixNano()) / float64(time.Millisecond)
+				if !seen[i] || ms < first[i] {
+					first[i] = ms
+				}
+				if !seen[i] || ms > last[i] {
+					last[i] = ms
+				}
+				seen[i] = true
+			}
+		}
+	}
+
+	err := filepath.WalkDir(replace.config.inputPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		return replace.scanFile(path, observe)
+	})
+	if err != nil {
+		if _, ok := err.(*json_error.IOError); ok {
+			return err
+		}
+		return &json_error.IOError{Path: replace.config.inputPath, Message: "Error: Failed to walk through the input directory", Err: err}
+	}
+
+	for i, r := range rules {
+		r.replay.first = first[i]
+		r.replay.scale = 0
+		if last[i] > first[i] {
+			r.replay.scale = float64(r.Duration) / (last[i] - first[i])
+		}
+	}
+	return nil
+}
+
+// Decode every record of a file and pass it to the function, with the prefix of the value in the record
+// and the rest of the record if the value is a part of a record in stream mode
+// Records not in valid JSON format are ignored, since they are handled when the file is processed
+func (replace *JSONReplace) scanFile(filePath string, fn func(record interface{}, prefix []interface{}, v interface{})) error {
+	input, err := json_compress.Open(filePath)
+	if err != nil {
+		return &json_error.IOError{Path: filePath, Message: "Error: Cannot read input file '" + filePath + "'", Err: err}
+	}
+	defer input.Close()
+	reader := bufio.NewReader(input)
+
+	if !replace.config.lineByLine {
+		// Documents are scanned token by token in stream mode, so that they are never decoded as a whole
+		if replace.config.stream {
+			err = scanDocument(json.NewDecoder(reader), fn)
+			var ioErr *json_error.IOError
+			if errors.As(err, &ioErr) {
+				return err
+			}
+			return nil
+		}
+		var v interface{}
+		if json.NewDecoder(reader).Decode(&v) == nil {
+			fn(nil, nil, v)
+		}
+		return nil
+	}
+
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return &json_error.IOError{Path: filePath, Message: "Error: Cannot read input file '" + filePath + "'", Err: readErr}
+		}
+		var v interface{}
+		if json.Unmarshal(bytes.TrimSuffix(line, []byte("\n")), &v) == nil {
+			fn(nil, nil, v)
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Pass the records of a JSON document to the function token by token, in the same parts as stream mode
+// processes them: elements of a top-level array are records by themselves, and the elements of the array
+// members of a top-level object are spooled while the rest of the object is read, then passed along with
+// the rest as their record
+func scanDocument(decoder *json.Decoder, fn func(record interface{}, prefix []interface{}, v interface{})) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	switch token {
+	case json.Delim('['):
+		for i := 0; decoder.More(); i++ {
+			var v interface{}
+			err = decoder.Decode(&v)
+			if err != nil {
+				return err
+			}
+			fn(nil, []interface{}{i}, v)
+		}
+		return nil
+	case json.Delim('{'):
+	default:
+		fn(nil, nil, token)
+		return nil
+	}
+
+	s, err := newSpool()
+	if err != nil {
+		return err
+	}
+	defer s.remove()
+
+	rest := map[string]interface{}{}
+	var arrays []*spooledArray
+	for decoder.More() {
+		token, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+		key := token.(string)
+
+		token, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('['):
+			a := &spooledArray{key: key}
+			err = s.spoolArray(decoder, a)
+			rest[key] = []interface{}{}
+			arrays = append(arrays, a)
+		case json.Delim('{'):
+			rest[key], err = decodeObject(decoder)
+		default:
+			rest[key] = token
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fn(nil, nil, rest)
+
+	for _, a := range arrays {
+		reader, err := s.reader(a.offset, a.end)
+		if err != nil {
+			return err
+		}
+		elements := json.NewDecoder(reader)
+		for i := 0; i < a.length; i++ {
+			var v interface{}
+			err = elements.Decode(&v)
+			if err != nil {
+				return err
+			}
+			fn(rest, []interface{}{a.key, i}, v)
+		}
+	}
+	return nil
+}
+
+// Parse an original timestamp in any representation detected by the auto format
+func parseTimestamp(v interface{}) (time.Time, bool) {
+	if s, ok := v.(string); ok {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(0, n*epochUnit(float64(n))), true
+		}
+		t, _, ok := parseDate(s)
+		return t, ok
+	}
+	if f, ok := toFloat(v); ok {
+		return time.Unix(0, int64(f*float64(epochUnit(f)))), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,84 @@
+package json_replace
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strings"
+)
+
+// Plan the replay states of every file in reproducible mode
+// Files are processed concurrently once to count the timestamps assigned in each of them, then the state
+// at the start of each file is derived in the order of file paths, so that the timestamps of a record
+// depend only on its file and line instead of the order in which routines finish
+func (replace *JSONReplace) planReplay() (map[string]map[*Rule]*Replay, error) {
+	var rules []*Rule
+	for _, r := range replace.rules {
+		if r.Type == "timestamp" {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	// Counting only needs the rules up to the last timestamp rule, which may drop records or change
+	// the fields and conditions of timestamp rules
+	// Tokenize rules are skipped, so that no token is added to vaults for records that are only counted
+	replace.countRules = nil
+	for _, r := range replace.rules {
+		if r.Type != "tokenize" {
+			replace.countRules = append(replace.countRules, r)
+		}
+		if r == rules[len(rules)-1] {
+			break
+		}
+	}
+
+	// Count the timestamps of every file, files are walked in lexical order
+	var states []*fileState
+	err := replace.walk(func(path string) *fileState {
+		state := &fileState{path: path, replays: map[*Rule]*Replay{}, counting: true}
+		for _, r := range rules {
+			state.replays[r] = &Replay{}
+		}
+		states = append(states, state)
+		return state
+	})
+	if err != nil {
+		return nil, err
+	}
+	replace.sync.assignCounter = 0
+	replace.sync.processCounter = 0
+
+	plan := map[string]map[*Rule]*Replay{}
+	for _, state := range states {
+		plan[state.path] = map[*Rule]*Replay{}
+	}
+	for _, r := range rules {
+		cursor := r.replay
+		for _, state := range states {
+			seed := replace.fileSeed(r.Seed, state.path)
+			replay := cursor
+			replay.random = rand.New(rand.NewSource(seed))
+			plan[state.path][r] = &replay
+
+			// Advance the cursor over the timestamps of the file with an identical random source
+			cursor.random = rand.New(rand.NewSource(seed))
+			for i := int64(0); i < state.replays[r].index; i++ {
+				if r.Profile != "preserve" {
+					cursor.time += replace.nextIncrement(r, &cursor)
+				}
+				cursor.index++
+			}
+		}
+	}
+	return plan, nil
+}
+
+// Return the seed of the random source of a file, derived from the seed of the rule and the path of the file
+// relative to the input path, so that every file has its own random source that is the same in every run
+func (replace *JSONReplace) fileSeed(seed int64, filePath string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.TrimPrefix(filePath, replace.config.inputPath)))
+	return seed ^ int64(h.Sum64())
+}
@@ -0,0 +1,601 @@
+package json_replace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"github.com/Joker-Jane/JSON-replacement/json_path"
+	"io"
+	"os"
+	"sort"
+)
+
+// Handle input json file in stream mode
+func (replace *JSONReplace) handleStream(state *fileState) error {
+	filePath := state.path
+
+	// Open the input file
+	input, err := json_compress.Open(filePath)
+	if err != nil {
+		return &json_error.IOError{Path: filePath, Message: "Error: Cannot read input file '" + filePath + "'", Err: err}
+	}
+	defer input.Close()
+
+	// Open or create the target file, nothing is written when the file is only counted,
+	// when records are emitted in replay mode, or in dry-run mode
+	var output *json_compress.File
+	var target string
+	writer := bufio.NewWriter(io.Discard)
+	if replace.stdout != nil && !state.counting {
+		target = json_compress.Stdio
+		writer = bufio.NewWriter(replace.stdout)
+	} else if !state.counting && replace.pacer == nil && replace.report == nil {
+		target, err = replace.createTarget(filePath)
+		if err != nil {
+			return err
+		}
+		output, err = json_compress.Create(target, replace.config.compress)
+		if err != nil {
+			return &json_error.IOError{Path: target, Message: "Error: Failed to open or create file '" + target + "'", Err: err}
+		}
+		defer output.Close()
+		writer = bufio.NewWriter(output)
+	}
+
+	reader := bufio.NewReader(input)
+
+	if replace.config.lineByLine {
+		err = replace.streamLines(reader, writer, state)
+		if err != nil {
+			return err
+		}
+	} else {
+		recorder := &recorder{reader: reader}
+		decoder := json.NewDecoder(recorder)
+		if replace.config.faithful {
+			decoder.UseNumber()
+		}
+		var dropped bool
+		dropped, err = replace.streamDocument(decoder, recorder, writer, state)
+		if err == nil && dropped {
+			// Skip the output file if the document is dropped as a whole
+			if output != nil {
+				output.Close()
+				os.Remove(target)
+			}
+			return nil
+		}
+		if err != nil {
+			// Remove the partial output file, and skip the file unless the error policy fails fast
+			if output != nil {
+				output.Close()
+				os.Remove(target)
+			}
+			return replace.handleInvalid(state, &json_error.JSONError{File: filePath, Line: replace.errorLine(filePath, err), Err: err}, nil)
+		}
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return &json_error.IOError{Path: target, Message: "Error: Cannot write to '" + target + "'", Err: err}
+	}
+
+	// Closing a compressed output file writes the end of its compressed stream
+	if output != nil {
+		err = output.Close()
+		if err != nil {
+			return &json_error.IOError{Path: target, Message: "Error: Cannot write to '" + target + "'", Err: err}
+		}
+	}
+	return nil
+}
+
+// Process and write the input line by line
+func (replace *JSONReplace) streamLines(reader *bufio.Reader, writer *bufio.Writer, state *fileState) error {
+	filePath := state.path
+	for l := 1; ; l++ {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return &json_error.IOError{Path: filePath, Message: "Error: Cannot read input file '" + filePath + "'", Err: readErr}
+		}
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		state.line = l
+		r, dropped, err := replace.handleJSON(line, state)
+		if err != nil {
+			// Skip the line unless the error policy fails fast
+			err = replace.handleInvalid(state, &json_error.JSONError{File: filePath, Line: l, Err: err}, line)
+			if err != nil {
+				return err
+			}
+		} else if !dropped && (replace.stdout == nil || len(line) > 0) {
+			// Empty lines are not written to stdout, which is shared by every file
+			// Records of files processed concurrently are written to stdout one at a time, each in a single write
+			if replace.stdout != nil {
+				_, err = replace.stdout.Write(append(r, '\n'))
+				if err != nil {
+					return &json_error.IOError{Path: json_compress.Stdio, Message: "Error: Cannot write to stdout", Err: err}
+				}
+			} else {
+				writer.Write(r)
+				writer.WriteByte('\n')
+			}
+			if replace.pacer != nil && !state.counting && len(line) > 0 {
+				err = replace.emit(state, r)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Process and write a JSON document token by token
+// Return if the document is dropped as a whole
+func (replace *JSONReplace) streamDocument(decoder *json.Decoder, recorder *recorder, writer *bufio.Writer, state *fileState) (bool, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return false, err
+	}
+
+	var dropped bool
+	switch token {
+	case json.Delim('['):
+		err = replace.streamArray(decoder, writer, state)
+	case json.Delim('{'):
+		dropped, err = replace.streamObject(decoder, recorder, writer, state)
+	default:
+		// A top-level scalar is a record by itself
+		var v interface{}
+		v, dropped, err = replace.handleValue(nil, token, state)
+		if err == nil && !dropped {
+			err = replace.writeValue(writer, v)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Nothing is allowed after the document
+	_, err = decoder.Token()
+	if err != io.EOF {
+		return false, errors.New("unexpected data after the document")
+	}
+	return dropped, nil
+}
+
+// Process and write the elements of a top-level array one by one, after its opening bracket is read
+// Every element is processed as a record by itself
+func (replace *JSONReplace) streamArray(decoder *json.Decoder, writer *bufio.Writer, state *fileState) error {
+	writer.WriteByte('[')
+	first := true
+	for i := 0; decoder.More(); i++ {
+		// Elements are decoded from their bytes so that they can be written faithfully
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err != nil {
+			return err
+		}
+		v, err := replace.decode(raw)
+		if err != nil {
+			return err
+		}
+
+		v, dropped, err := replace.handleValue([]interface{}{i}, v, state)
+		if err != nil {
+			return err
+		}
+		if dropped || v == json_path.Delete {
+			continue
+		}
+
+		if !first {
+			writer.WriteByte(',')
+		}
+		first = false
+		record := replace.encode(v, raw)
+		_, err = writer.Write(record)
+		if err != nil {
+			return err
+		}
+		if replace.pacer != nil && !state.counting {
+			err = replace.emit(state, record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Read the closing bracket
+	_, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	writer.WriteByte(']')
+	return nil
+}
+
+// Process and write a top-level object as a record, after its opening brace is read
+// The elements of array members are spooled to a temporary file while the rest of the object is read,
+// then the rest of the object is processed as the record, before any element is processed,
+// so that record-level rules apply on the whole record and the rules on the elements see the rest of it
+// Other members are decoded from their bytes recorded by the recorder, so that they are written faithfully
+// Members are written in the order of keys, or in the order of the input in faithful mode
+// Return if the object is dropped
+func (replace *JSONReplace) streamObject(decoder *json.Decoder, recorder *recorder, writer *bufio.Writer, state *fileState) (bool, error) {
+	s, err := newSpool()
+	if err != nil {
+		return false, err
+	}
+	defer s.remove()
+
+	rest := map[string]interface{}{}
+	raws := map[string][]byte{}
+	var order []string
+	var arrays []*spooledArray
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return false, err
+		}
+		key := token.(string)
+		order = append(order, key)
+
+		offset := decoder.InputOffset()
+		recorder.start(decoder)
+		token, err = decoder.Token()
+		if err != nil {
+			return false, err
+		}
+		if token == json.Delim('[') {
+			recorder.stop(0)
+			a := &spooledArray{key: key, placeholder: make([]interface{}, 0, 1)}
+			err = s.spoolArray(decoder, a)
+			if err != nil {
+				return false, err
+			}
+			rest[key] = a.placeholder
+			arrays = append(arrays, a)
+			continue
+		}
+		if token == json.Delim('{') {
+			_, err = decodeObject(decoder)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		// The recorded bytes start with the colon after the key
+		raw := recorder.stop(decoder.InputOffset() - offset)
+		raw = bytes.TrimSpace(raw[bytes.IndexByte(raw, ':')+1:])
+		raws[key] = raw
+		rest[key], err = replace.decode(raw)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Read the closing brace
+	_, err = decoder.Token()
+	if err != nil {
+		return false, err
+	}
+
+	// Process the rest of the record, recording it before every rule for the rules on the elements
+	state.recording = true
+	v, dropped, err := replace.handleValue(nil, rest, state)
+	state.recording = false
+	defer func() {
+		state.records = nil
+	}()
+	if err != nil {
+		return false, err
+	}
+	if dropped {
+		return true, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return false, replace.writeValue(writer, v)
+	}
+
+	var keys []string
+	if replace.config.faithful {
+		for _, k := range order {
+			if _, found := m[k]; found {
+				keys = append(keys, k)
+			}
+		}
+	}
+	var added []string
+	for k := range m {
+		if _, found := rest[k]; !found || !replace.config.faithful {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	keys = append(keys, added...)
+
+	// Process the elements of the arrays kept by the rules, which are found by their placeholders
+	// even if their keys are renamed
+	// The whole record is dropped if a drop-record rule matches any element
+	spooled := map[string]*spooledArray{}
+	for _, k := range keys {
+		for _, a := range arrays {
+			if !a.isPlaceholder(m[k]) {
+				continue
+			}
+			dropped, err = replace.processSpooled(s, a, state)
+			if err != nil || dropped {
+				return dropped, err
+			}
+			spooled[k] = a
+		}
+	}
+
+	writer.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			writer.WriteByte(',')
+		}
+		err = replace.writeValue(writer, k)
+		if err != nil {
+			return false, err
+		}
+		writer.WriteByte(':')
+		if a, found := spooled[k]; found {
+			err = replace.writeSpooled(writer, s, a, state)
+		} else if raw, found := raws[k]; found {
+			_, err = writer.Write(replace.encode(m[k], raw))
+		} else {
+			err = replace.writeValue(writer, m[k])
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	writer.WriteByte('}')
+	return false, nil
+}
+
+// Process the spooled elements of an array of a record, and spool the results
+// Return if the record is dropped by a drop-record rule matching an element
+func (replace *JSONReplace) processSpooled(s *spool, a *spooledArray, state *fileState) (bool, error) {
+	reader, err := s.reader(a.offset, a.end)
+	if err != nil {
+		return false, err
+	}
+	decoder := json.NewDecoder(reader)
+	a.start = s.size
+	for i := 0; i < a.length; i++ {
+		var raw json.RawMessage
+		err = decoder.Decode(&raw)
+		if err != nil {
+			return false, err
+		}
+		v, err := replace.decode(raw)
+		if err != nil {
+			return false, err
+		}
+
+		v, dropped, err := replace.handleValue([]interface{}{a.key, i}, v, state)
+		if err != nil {
+			return false, err
+		}
+		if dropped {
+			return true, nil
+		}
+		if v == json_path.Delete {
+			continue
+		}
+		record := replace.encode(v, raw)
+		err = s.write(record)
+		if err != nil {
+			return false, err
+		}
+		a.sizes = append(a.sizes, len(record))
+	}
+	return false, nil
+}
+
+// Write the processed elements of an array of a record from the spool
+func (replace *JSONReplace) writeSpooled(writer *bufio.Writer, s *spool, a *spooledArray, state *fileState) error {
+	reader, err := s.reader(a.start, s.size)
+	if err != nil {
+		return err
+	}
+	writer.WriteByte('[')
+	for i, size := range a.sizes {
+		record := make([]byte, size)
+		_, err = io.ReadFull(reader, record)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			writer.WriteByte(',')
+		}
+		_, err = writer.Write(record)
+		if err != nil {
+			return err
+		}
+		if replace.pacer != nil && !state.counting {
+			err = replace.emit(state, record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	writer.WriteByte(']')
+	return nil
+}
+
+// spooledArray struct records an array member of a record, whose elements are spooled until the rest is processed
+type spooledArray struct {
+	key string
+
+	// Placeholder of the array in the rest of the record, which is found by its identity after the rules apply
+	placeholder []interface{}
+
+	// Position of the raw elements in the spool, and the number of them
+	offset int64
+	end    int64
+	length int
+
+	// Position of the processed elements in the spool, and the size of each of them
+	start int64
+	sizes []int
+}
+
+// Return if a value is the placeholder of the array
+func (a *spooledArray) isPlaceholder(v interface{}) bool {
+	p, ok := v.([]interface{})
+	return ok && cap(p) > 0 && &p[:1][0] == &a.placeholder[:1][0]
+}
+
+// spool struct appends bytes to a temporary file and reads them back
+type spool struct {
+	file   *os.File
+	writer *bufio.Writer
+
+	// Number of bytes appended
+	size int64
+}
+
+// Create a spool in the temporary directory
+func newSpool() (*spool, error) {
+	file, err := os.CreateTemp("", "json_replace-*")
+	if err != nil {
+		return nil, &json_error.IOError{Path: os.TempDir(), Message: "Error: Cannot create a temporary file in '" + os.TempDir() + "'", Err: err}
+	}
+	return &spool{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Append bytes to the spool
+func (s *spool) write(p []byte) error {
+	n, err := s.writer.Write(p)
+	s.size += int64(n)
+	return err
+}
+
+// Copy the raw elements of an array to the spool, one element per line, after its opening bracket is read
+func (s *spool) spoolArray(decoder *json.Decoder, a *spooledArray) error {
+	a.offset = s.size
+	for decoder.More() {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err != nil {
+			return err
+		}
+		err = s.write(append(raw, '\n'))
+		if err != nil {
+			return err
+		}
+		a.length++
+	}
+	a.end = s.size
+
+	// Read the closing bracket
+	_, err := decoder.Token()
+	return err
+}
+
+// Return a reader of the bytes of the spool between two positions
+func (s *spool) reader(start int64, end int64) (*bufio.Reader, error) {
+	err := s.writer.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(io.NewSectionReader(s.file, start, end-start)), nil
+}
+
+// Close and remove the temporary file of the spool
+func (s *spool) remove() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// recorder struct passes the bytes of a reader to a decoder, and records them while a value is decoded,
+// so that the bytes of the value are kept even if it is read token by token
+type recorder struct {
+	reader io.Reader
+
+	// Recorded bytes, which is nil if nothing is recorded
+	buffer *bytes.Buffer
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if r.buffer != nil {
+		r.buffer.Write(p[:n])
+	}
+	return n, err
+}
+
+// Start recording from the current position of the decoder, including the bytes it has read ahead
+func (r *recorder) start(decoder *json.Decoder) {
+	r.buffer = &bytes.Buffer{}
+	r.buffer.ReadFrom(decoder.Buffered())
+}
+
+// Stop recording, and return the recorded bytes up to the size
+func (r *recorder) stop(size int64) []byte {
+	recorded := r.buffer.Bytes()[:size]
+	r.buffer = nil
+	return recorded
+}
+
+// Return the line of a syntax error of a document in stream mode, by reading the file again up to the offset
+// of the error, or 0 if the error has no offset or the file cannot be read again, such as stdin
+func (replace *JSONReplace) errorLine(filePath string, err error) int {
+	if filePath == json_compress.Stdio {
+		return 0
+	}
+	input, openErr := json_compress.Open(filePath)
+	if openErr != nil {
+		return 0
+	}
+	defer input.Close()
+	return json_error.Line(input, err)
+}
+
+// Decode the members of an object after its opening brace is read
+func decodeObject(decoder *json.Decoder) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		err = decoder.Decode(&v)
+		if err != nil {
+			return nil, err
+		}
+		m[token.(string)] = v
+	}
+
+	// Read the closing brace
+	_, err := decoder.Token()
+	return m, err
+}
+
+// Encode and write a value, HTML characters are not escaped in faithful mode
+func (replace *JSONReplace) writeValue(writer *bufio.Writer, v interface{}) error {
+	if replace.config.faithful {
+		_, err := writer.Write(marshal(v))
+		return err
+	}
+	result, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(result)
+	return err
+}
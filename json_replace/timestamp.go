@@ -0,0 +1,95 @@
+package json_replace
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Nanoseconds of the units of epoch formats
+var epochUnits = map[string]int64{
+	"epoch-s":  int64(time.Second),
+	"epoch-ms": int64(time.Millisecond),
+	"epoch-us": int64(time.Microsecond),
+	"epoch-ns": 1,
+}
+
+// Check the format and the timezone of a timestamp rule
+// The format is auto, rfc3339, an epoch format, or a custom layout such as 2006-01-02 15:04:05
+func (r *Rule) prepareTimestamp() error {
+	r.location = time.UTC
+	if r.Timezone != "" {
+		location, err := time.LoadLocation(r.Timezone)
+		if err != nil {
+			return errors.New("Invalid timezone '" + r.Timezone + "'")
+		}
+		r.location = location
+	}
+
+	switch r.Format {
+	case "", "auto", "rfc3339", "epoch-s", "epoch-ms", "epoch-us", "epoch-ns":
+	default:
+		// A custom layout must contain elements of the reference time
+		if time.Unix(0, 0).Format(r.Format) == r.Format {
+			return errors.New("Invalid format '" + r.Format + "'")
+		}
+	}
+	return nil
+}
+
+// Format a replay time in epoch milliseconds in the format of the rule
+// In auto format, the time is written in the same representation as the original value,
+// or in epoch milliseconds if the field is missing or the representation is unknown
+func (r *Rule) formatTimestamp(ms int64, original interface{}) interface{} {
+	t := time.UnixMilli(ms).In(r.location)
+
+	switch r.Format {
+	case "", "epoch-ms":
+		return ms
+	case "epoch-s", "epoch-us", "epoch-ns":
+		return t.UnixNano() / epochUnits[r.Format]
+	case "rfc3339":
+		return t.Format(time.RFC3339Nano)
+	case "auto":
+		return r.formatAuto(t, original)
+	}
+	return t.Format(r.Format)
+}
+
+// Format a time in the same representation as the original value
+func (r *Rule) formatAuto(t time.Time, original interface{}) interface{} {
+	if s, ok := original.(string); ok {
+		// Numeric strings are epoch timestamps kept as strings
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return strconv.FormatInt(t.UnixNano()/epochUnit(float64(n)), 10)
+		}
+
+		// Keep the offset of the original value unless a timezone is specified
+		if parsed, format, ok := parseDate(s); ok {
+			if r.Timezone == "" {
+				t = t.In(parsed.Location())
+			}
+			return format(t)
+		}
+	}
+	if f, ok := toFloat(original); ok {
+		return t.UnixNano() / epochUnit(f)
+	}
+	return t.UnixMilli()
+}
+
+// Return the unit of an epoch timestamp in nanoseconds, guessed by its magnitude
+// Timestamps between 1973 and 5138 are distinguished correctly
+func epochUnit(n float64) int64 {
+	n = math.Abs(n)
+	switch {
+	case n < 1e11:
+		return epochUnits["epoch-s"]
+	case n < 1e14:
+		return epochUnits["epoch-ms"]
+	case n < 1e17:
+		return epochUnits["epoch-us"]
+	}
+	return epochUnits["epoch-ns"]
+}
@@ -0,0 +1,139 @@
+package json_replace
+
+import (
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_condition"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"github.com/Joker-Jane/JSON-replacement/json_rules"
+	"strconv"
+	"strings"
+)
+
+// Check the arguments and the rule file without processing anything
+// Return a ValidationError reporting every problem, or nil if there is none
+func Validate(config *Config) error {
+	e := &json_error.ValidationError{}
+
+	if config.inputPath != json_compress.Stdio {
+		e.CheckInput("-i", config.inputPath)
+	}
+	if config.replayTarget == "" && config.outputPath != json_compress.Stdio {
+		e.CheckOutput("-o", config.outputPath, false)
+	}
+	if (config.inputPath == json_compress.Stdio || config.outputPath == json_compress.Stdio) && !config.lineByLine {
+		e.AddFlag("-l", "Input from stdin and output to stdout require line-by-line mode")
+	}
+	if config.auditPath != "" {
+		e.CheckOutput("-a", config.auditPath, false)
+		if config.auditSalt == "" {
+			e.AddFlag("-z", "Audit log must specify a salt")
+		}
+	}
+	if config.reportPath != "" && config.reportPath != "-" {
+		e.CheckOutput("-y", config.reportPath, false)
+	}
+	if config.maxRoutines <= 0 {
+		e.AddFlag("-n", "Maximum number of routines must be greater than 0")
+	}
+	if config.replayTarget != "" && config.replaySpeed <= 0 {
+		e.AddFlag("-x", "Replay speed must be greater than 0")
+	}
+	e.CheckPolicy(config.errorPolicy, config.deadLetterPath)
+	if err := json_compress.Check(config.compress); err != nil {
+		e.AddFlagError("-g", err)
+	}
+
+	// Detokenize mode reads the vault instead of the rule file
+	switch config.mode {
+	case ModeReplace:
+	case ModeDetokenize:
+		e.CheckInput("-v", config.vaultPath)
+		if config.vaultKey == "" {
+			e.AddFlag("-k", "Vault key must be specified")
+		}
+		return e.Err()
+	default:
+		e.AddFlag("-m", "Mode must be "+ModeReplace+" or "+ModeDetokenize)
+		return e.Err()
+	}
+
+	if config.rulePath == "" {
+		e.AddFlag("-r", "Rule path must be specified")
+		return e.Err()
+	}
+	content, err := json_rules.Load(config.rulePath)
+	if err != nil {
+		if _, ok := err.(*json_error.IOError); ok {
+			e.AddFlagError("-r", err)
+		} else {
+			e.Add("", strings.TrimPrefix(err.Error(), "Error: "))
+		}
+		return e.Err()
+	}
+	rules := validateRules(content, e)
+
+	if config.inputPath == json_compress.Stdio && scansInput(config, rules) {
+		e.AddFlag("-i", "Input from stdin cannot be read by reproducible mode or timestamp rules of the preserve profile")
+	}
+
+	if config.replayTarget != "" {
+		timed := false
+		for _, r := range rules {
+			timed = timed || r.Type == "timestamp"
+		}
+		if !timed {
+			e.AddFlag("-p", "Replay mode requires a timestamp rule")
+		}
+	}
+	return e.Err()
+}
+
+// Validate every rule of a rule file, and return the rules that are decoded
+func validateRules(content []byte, e *json_error.ValidationError) []*Rule {
+	values, ok := json_error.ParseRules(content, e)
+	if !ok {
+		return nil
+	}
+
+	var rules []*Rule
+	orders := map[int]string{}
+	for i, v := range values {
+		p := json_error.Pointer("", i)
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			e.Add(p, "Rule must be an object")
+			continue
+		}
+		json_condition.Validate(json_error.Pointer(p, "when"), object["when"], e)
+		r := &Rule{}
+		if !e.CheckFields(p, object, r, "when") {
+			continue
+		}
+		rules = append(rules, r)
+
+		// Rules of the same order are applied in an undefined order
+		if first, found := orders[r.Order]; found {
+			e.Add(json_error.Pointer(p, "order"), "Duplicate order "+strconv.Itoa(r.Order)+" of the rule at "+strconv.Quote(first))
+		} else {
+			orders[r.Order] = p
+		}
+
+		r.validate(p, e)
+	}
+	return rules
+}
+
+// Validate a single rule at the JSON pointer by the same check as before processing, reporting every problem
+// Problems of the when block are skipped, which are located more precisely by json_condition
+func (r *Rule) validate(p string, e *json_error.ValidationError) {
+	r.check(func(message string, location ...interface{}) {
+		if len(location) > 0 && location[0] == "when" {
+			return
+		}
+		pointer := p
+		for _, token := range location {
+			pointer = json_error.Pointer(pointer, token)
+		}
+		e.Add(pointer, message)
+	})
+}
@@ -0,0 +1,255 @@
+package json_replace
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Default prefix of tokens
+const defaultTokenPrefix = "tok_"
+
+// Vault files start with the magic bytes and the salt of the key, followed by the nonce and the encrypted originals
+var vaultMagic = []byte("JRVAULT1")
+
+// Size of the random salt of the key of a vault
+const vaultSaltSize = 16
+
+// Vault struct stores the original values of tokens in an AES-GCM encrypted file
+type Vault struct {
+	// Path to the vault file
+	path string
+
+	// AES-256 key derived from the passphrase and the salt
+	key  []byte
+	salt []byte
+
+	// Map from tokens to original values
+	originals map[string]interface{}
+
+	// Map from JSON encoded original values to tokens
+	tokens map[string]string
+
+	// Whether new tokens are added since the vault is loaded
+	modified bool
+
+	// Lock for updating the vault
+	lock sync.Mutex
+}
+
+// Open a vault file, or create an empty vault with a random salt if the file does not exist
+func OpenVault(path string, passphrase string) (*Vault, error) {
+	v := &Vault{
+		path:      path,
+		originals: map[string]interface{}{},
+		tokens:    map[string]string{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		v.salt = make([]byte, vaultSaltSize)
+		_, err = io.ReadFull(rand.Reader, v.salt)
+		if err != nil {
+			return nil, err
+		}
+		v.key, err = deriveVaultKey(passphrase, v.salt)
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	// The header of magic bytes and salt is authenticated along with the encrypted originals
+	header := len(vaultMagic) + vaultSaltSize
+	if len(data) < header || !bytes.Equal(data[:len(vaultMagic)], vaultMagic) {
+		return nil, errors.New("Vault file '" + path + "' is corrupted")
+	}
+	v.salt = data[len(vaultMagic):header]
+	v.key, err = deriveVaultKey(passphrase, v.salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := v.cipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < header+gcm.NonceSize() {
+		return nil, errors.New("Vault file '" + path + "' is corrupted")
+	}
+	nonce := data[header : header+gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, data[header+gcm.NonceSize():], data[:header])
+	if err != nil {
+		return nil, errors.New("Cannot decrypt vault file '" + path + "' with the given key")
+	}
+	// Numbers are decoded as json.Number so that they are restored with all their digits
+	decoder := json.NewDecoder(bytes.NewReader(plain))
+	decoder.UseNumber()
+	err = decoder.Decode(&v.originals)
+	if err != nil {
+		return nil, errors.New("Vault file '" + path + "' is corrupted")
+	}
+
+	for token, original := range v.originals {
+		v.tokens[tokenKey(original)] = token
+	}
+	return v, nil
+}
+
+// Return the key of an original value in the map of tokens
+// Numbers are keyed by their canonical literals, and other values by their JSON representation,
+// so that 42 and "42" have different tokens
+func tokenKey(value interface{}) string {
+	if literal, ok := numberLiteral(value); ok {
+		return literal
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// Derive the AES-256 key of a vault from the passphrase and the salt by scrypt
+func deriveVaultKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// Check if the passphrase derives the key of the vault
+func (v *Vault) matches(passphrase string) bool {
+	key, err := deriveVaultKey(passphrase, v.salt)
+	return err == nil && subtle.ConstantTimeCompare(key, v.key) == 1
+}
+
+// Encrypt and write the vault to its file if new tokens are added
+// The file is replaced atomically, so that a failure never leaves the vault partially written
+func (v *Vault) Save() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.modified {
+		return nil
+	}
+
+	plain, err := json.Marshal(v.originals)
+	if err != nil {
+		return err
+	}
+	gcm, err := v.cipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+
+	header := append(append([]byte{}, vaultMagic...), v.salt...)
+	data := append(header, gcm.Seal(nonce, nonce, plain, header)...)
+	err = writeFileAtomic(v.path, data)
+	if err != nil {
+		return err
+	}
+	v.modified = false
+	return nil
+}
+
+// Write a file by writing a temporary file in the same directory, syncing it to the disk,
+// and renaming it to the path, so that the file is either the old one or the new one as a whole
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Create the AES-GCM cipher of the vault
+func (v *Vault) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(v.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Replace a value with a random token and record the pair in the vault
+// The same value is always replaced with the same token
+// Return an error if no random token can be generated
+func (v *Vault) tokenize(value interface{}, prefix string) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if prefix == "" {
+		prefix = defaultTokenPrefix
+	}
+	key := tokenKey(value)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	token, found := v.tokens[key]
+	if found {
+		return token, nil
+	}
+	for {
+		b := make([]byte, 8)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		token = prefix + hex.EncodeToString(b)
+		if _, exists := v.originals[token]; !exists {
+			break
+		}
+	}
+	v.tokens[key] = token
+	v.originals[token] = value
+	v.modified = true
+	return token, nil
+}
+
+// Restore the original value of a token, other values are returned untouched
+func (v *Vault) detokenize(value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	original, found := v.originals[s]
+	if found {
+		return original
+	}
+	return value
+}
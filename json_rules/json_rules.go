@@ -0,0 +1,291 @@
+/*
+This package loads the rule files of json_replace and json_select.
+
+A rule file is in JSON format, or in YAML format with comments if its extension is .yaml or .yml.
+It is either an array of rules, or an object of the following fields:
+
+	include
+		An array of paths to other rule files, relative to the directory of the rule file.
+		Their rules are placed before the rules of the rule file, in the order of the paths,
+		and their definitions are shared by every file. A file included more than once is loaded once.
+
+	definitions
+		An object of named values, such as lists of conditions or lists of values.
+
+	rules
+		An array of rules.
+
+Every object with a single field $ref in rules or definitions is replaced by the definition it names.
+A reference to an array inside an array is spliced into the array, so that lists can be combined:
+
+	definitions:
+	  # Records of staff accounts
+	  staff:
+	    - type: suffix
+	      key: email
+	      values: ["@example.com"]
+	rules:
+	  - position: 1
+	    output: staff
+	    conditions:
+	      - $ref: staff
+	      - type: exist
+	        key: user.id
+
+The rules of every file are loaded into a single array of rules in JSON format.
+*/
+package json_rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loader struct records the state of loading a rule file and the files it includes
+type loader struct {
+	// Definitions of every file by name, and the files defining them
+	definitions map[string]interface{}
+	definedIn   map[string]string
+
+	// Files by absolute path, true if loaded and false if being loaded
+	files map[string]bool
+}
+
+// Load a rule file and the files it includes, and return the array of rules in JSON format
+// A JSON array of rules is returned as it is, and a file not in valid JSON format is returned
+// as it is for the caller to report
+func Load(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &json_error.IOError{Path: path, Message: "Error: Cannot read rule file '" + path + "'", Err: err}
+	}
+	if !isYAML(path) {
+		var v interface{}
+		if json.Unmarshal(content, &v) != nil {
+			return content, nil
+		}
+		if _, ok := v.([]interface{}); ok {
+			return content, nil
+		}
+	}
+
+	l := &loader{
+		definitions: map[string]interface{}{},
+		definedIn:   map[string]string{},
+		files:       map[string]bool{},
+	}
+	rules, err := l.load(path)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := l.resolve(rules, nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resolved)
+}
+
+// Return if the file is in YAML format by its extension
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Load a rule file, its includes and its definitions, and return its rules after the rules of its includes
+func (l *loader) load(path string) ([]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, &json_error.IOError{Path: path, Message: "Error: Cannot read rule file '" + path + "'", Err: err}
+	}
+	loaded, found := l.files[abs]
+	if found {
+		if !loaded {
+			return nil, &json_error.RuleError{Message: "Error: Rule file '" + path + "' includes itself"}
+		}
+		return nil, nil
+	}
+	l.files[abs] = false
+
+	v, err := parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []interface{}
+	switch v := v.(type) {
+	case []interface{}:
+		rules = v
+	case map[string]interface{}:
+		rules, err = l.loadObject(path, v)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &json_error.RuleError{Message: "Error: Rule file '" + path + "' must be an array of rules or an object of include, definitions and rules"}
+	}
+
+	l.files[abs] = true
+	return rules, nil
+}
+
+// Load the include, definitions and rules fields of a rule file
+func (l *loader) loadObject(path string, v map[string]interface{}) ([]interface{}, error) {
+	for k := range v {
+		if k != "include" && k != "definitions" && k != "rules" {
+			return nil, &json_error.RuleError{Message: "Error: Unknown field '" + k + "' in rule file '" + path + "'"}
+		}
+	}
+
+	// Load the rules of included files first
+	var rules []interface{}
+	includes, ok := v["include"].([]interface{})
+	if v["include"] != nil && !ok {
+		return nil, &json_error.RuleError{Message: "Error: Include of rule file '" + path + "' must be an array of paths"}
+	}
+	for _, include := range includes {
+		p, ok := include.(string)
+		if !ok {
+			return nil, &json_error.RuleError{Message: "Error: Include of rule file '" + path + "' must be an array of paths"}
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(path), p)
+		}
+		included, err := l.load(p)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, included...)
+	}
+
+	definitions, ok := v["definitions"].(map[string]interface{})
+	if v["definitions"] != nil && !ok {
+		return nil, &json_error.RuleError{Message: "Error: Definitions of rule file '" + path + "' must be an object"}
+	}
+	for name, d := range definitions {
+		if other, found := l.definedIn[name]; found {
+			return nil, &json_error.RuleError{Message: "Error: Definition '" + name + "' of rule file '" + path + "' is already defined in '" + other + "'"}
+		}
+		l.definitions[name] = d
+		l.definedIn[name] = path
+	}
+
+	own, ok := v["rules"].([]interface{})
+	if v["rules"] != nil && !ok {
+		return nil, &json_error.RuleError{Message: "Error: Rules of rule file '" + path + "' must be an array"}
+	}
+	return append(rules, own...), nil
+}
+
+// Parse a rule file in JSON or YAML format into generic values
+// Numbers in JSON format are kept as json.Number, so that their literals are kept
+func parse(path string) (interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &json_error.IOError{Path: path, Message: "Error: Cannot read rule file '" + path + "'", Err: err}
+	}
+
+	var v interface{}
+	if isYAML(path) {
+		err = yaml.Unmarshal(content, &v)
+		if err != nil {
+			return nil, &json_error.RuleError{Message: "Error: Rule file '" + path + "' is not in valid YAML format: " + err.Error()}
+		}
+		return normalize(v), nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	err = decoder.Decode(&v)
+	if err != nil {
+		return nil, &json_error.RuleError{Message: "Error: Rule file '" + path + "' is not in valid JSON format: " + err.Error()}
+	}
+	return v, nil
+}
+
+// Convert mappings with keys other than strings decoded from YAML, so that they can be encoded in JSON
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = normalize(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalize(e)
+		}
+		return v
+	}
+	return v
+}
+
+// Return the name of the definition if the value is a reference
+func reference(v interface{}) (string, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	name, ok := m["$ref"].(string)
+	return name, ok
+}
+
+// Replace every reference in the value by its definition
+// The names of the definitions being resolved are in the stack, to find definitions referencing themselves
+func (l *loader) resolve(v interface{}, stack []string) (interface{}, error) {
+	if name, ok := reference(v); ok {
+		d, found := l.definitions[name]
+		if !found {
+			return nil, &json_error.RuleError{Message: "Error: Undefined reference '" + name + "'"}
+		}
+		for _, s := range stack {
+			if s == name {
+				return nil, &json_error.RuleError{Message: "Error: Definition '" + name + "' references itself"}
+			}
+		}
+		return l.resolve(d, append(stack, name))
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			r, err := l.resolve(e, stack)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = r
+		}
+		return m, nil
+	case []interface{}:
+		a := []interface{}{}
+		for _, e := range v {
+			r, err := l.resolve(e, stack)
+			if err != nil {
+				return nil, err
+			}
+
+			// Splice a referenced array
+			if _, ok := reference(e); ok {
+				if spliced, ok := r.([]interface{}); ok {
+					a = append(a, spliced...)
+					continue
+				}
+			}
+			a = append(a, r)
+		}
+		return a, nil
+	}
+	return v, nil
+}
@@ -2,6 +2,8 @@ package json_select
 
 import (
 	"flag"
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
 	"path/filepath"
 )
 
@@ -10,6 +12,19 @@ type Config struct {
 	outputPath  string
 	rulePath    string
 	maxRoutines int
+
+	// Path to the report of dry-run mode, which writes nothing else if specified
+	reportPath string
+
+	// Format of compression of output files, which is empty if they are not compressed
+	compress string
+
+	// Whether the arguments and the rule file are only checked
+	validate bool
+
+	// Policy of handling invalid records, and the path to the dead-letter file of quarantined records
+	errorPolicy    json_error.Policy
+	deadLetterPath string
 }
 
 func NewConfig(inputPath string, outputPath string, rulePath string, maxRoutines int) *Config {
@@ -30,14 +45,48 @@ func NewDefaultConfig(inputPath string, outputPath string, rulePath string) *Con
 	return NewConfig(inputPath, outputPath, rulePath, 10)
 }
 
+// Enable dry-run mode if the report path is not empty, which processes everything without writing outputs,
+// and writes a report of the records matched by each rule to the path, or to stdout if the path is -
+func (c *Config) SetDryRun(reportPath string) {
+	c.reportPath = reportPath
+}
+
+// Set the format of compression of output files, gzip or zstd, or disable it with an empty format
+func (c *Config) SetCompress(compression string) {
+	c.compress = compression
+}
+
+// Enable or disable validate mode, which only checks the arguments and the rule file and reports every problem
+func (c *Config) SetValidate(validate bool) {
+	c.validate = validate
+}
+
+// Set the policy of handling records not in valid JSON format, which is fail, skip or quarantine
+// Quarantined records are written with the reason to the dead-letter file
+func (c *Config) SetErrorPolicy(policy json_error.Policy, deadLetterPath string) {
+	c.errorPolicy = policy
+	c.deadLetterPath = deadLetterPath
+}
+
 func NewConfigFromConsole() *Config {
 	// Config and parse flags
 	inputPath := flag.String("i", "", "input path")
 	outputPath := flag.String("o", "", "output path")
 	rulePath := flag.String("r", "", "rule path")
 	maxRoutines := flag.Int("n", 10, "maximum routines")
+	reportPath := flag.String("y", "", "dry-run report path")
+	validate := flag.Bool("c", false, "validate the arguments and the rule file")
+	errorPolicy := flag.String("e", "fail", "error policy of fail, skip or quarantine")
+	deadLetterPath := flag.String("d", "", "dead-letter path")
+	var compression json_compress.Compression
+	flag.Var(&compression, "g", "compress outputs by gzip, or by the format of -g=format")
 
 	flag.Parse()
 
-	return NewConfig(*inputPath, *outputPath, *rulePath, *maxRoutines)
+	c := NewConfig(*inputPath, *outputPath, *rulePath, *maxRoutines)
+	c.reportPath = *reportPath
+	c.compress = string(compression)
+	c.validate = *validate
+	c.SetErrorPolicy(json_error.Policy(*errorPolicy), *deadLetterPath)
+	return c
 }
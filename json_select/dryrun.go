@@ -0,0 +1,104 @@
+package json_select
+
+import (
+	"encoding/json"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"os"
+	"sync"
+)
+
+// Samples of records reported for each rule
+const reportSamples = 3
+
+// Report struct represents the records matched by the rules, reported in dry-run mode
+type Report struct {
+	Files   int           `json:"files"`
+	Records int           `json:"records"`
+	Invalid int           `json:"invalid"`
+	Rules   []*RuleReport `json:"rules"`
+
+	// Records matching no rule
+	Default *OutputReport `json:"default"`
+
+	// Lock for updating the report
+	lock sync.Mutex
+}
+
+// RuleReport struct represents the records matched by a single rule
+type RuleReport struct {
+	Position int `json:"position"`
+	OutputReport
+}
+
+// OutputReport struct represents the records sent to an output, in total and in each file
+type OutputReport struct {
+	Output  string         `json:"output"`
+	Records int            `json:"records"`
+	Files   map[string]int `json:"files"`
+	Samples []*Sample      `json:"samples"`
+}
+
+// Sample struct represents a record and its location
+type Sample struct {
+	File   string          `json:"file"`
+	Line   int             `json:"line"`
+	Record json.RawMessage `json:"record"`
+}
+
+// Create an empty report of the rules
+func newReport(rules []*Rule) *Report {
+	report := &Report{Rules: []*RuleReport{}, Default: newOutputReport("default")}
+	for _, r := range rules {
+		report.Rules = append(report.Rules, &RuleReport{Position: r.Position, OutputReport: *newOutputReport(r.Output)})
+	}
+	return report
+}
+
+// Create an empty report of an output
+func newOutputReport(output string) *OutputReport {
+	return &OutputReport{Output: output, Files: map[string]int{}, Samples: []*Sample{}}
+}
+
+// Record a record matched by the rule at the index, or matching no rule if the index is -1
+func (report *Report) add(index int, record []byte, filePath string, line int) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	output := report.Default
+	if index >= 0 {
+		output = &report.Rules[index].OutputReport
+	}
+	report.Records++
+	output.Records++
+	output.Files[filePath]++
+	if len(output.Samples) < reportSamples {
+		sample := &Sample{File: filePath, Line: line, Record: append(json.RawMessage{}, record...)}
+		output.Samples = append(output.Samples, sample)
+	}
+}
+
+// Count a processed file
+func (report *Report) addFile() {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.Files++
+}
+
+// Write the report in JSON format to the path, or to stdout if the path is -
+func (report *Report) write(path string, invalid int) error {
+	report.Invalid = invalid
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(content)
+		return err
+	}
+	err = os.WriteFile(path, content, 0666)
+	if err != nil {
+		return &json_error.IOError{Path: path, Message: "Error: Failed to write report '" + path + "'", Err: err}
+	}
+	return nil
+}
@@ -4,9 +4,15 @@ records to output file(s) based on some predefined parameters.
 
 The records should be passed in the format of one line per JSON record.
 
-The input path can be either a file or a directory.
-The output path must be a directory.
-The rule path must be a JSON file that contains an array of valid rule JSONs.
+The input path can be either a file or a directory, or - to read records from stdin.
+Input files compressed by gzip, bzip2 or zstd are decompressed while they are read, as done by package json_compress.
+The output path must be a directory, with a file named after each output, or - to write records to stdout,
+where every record is tagged with the name of its output in the field _output, placed before its other fields.
+Records which are not objects are written to stdout as they are.
+The rule path must be a JSON or YAML file that contains an array of valid rule JSONs, which may include
+other rule files and reference shared definitions, as loaded by package json_rules.
+Conditions are evaluated by package json_condition, and their keys are paths in the syntax
+of package json_path, such as events[*].type or **.token.
 
 -i, -o, and -c flags must be specified.
 -n flags is optional.
@@ -21,36 +27,65 @@ Usage:
 Flags:
 
 	-i input_path
-		Set the path to the input file or directory.
+		Set the path to the input file or directory, or - for stdin.
 
 	-o output_path
-		Set the path to the output directory.
+		Set the path to the output directory, or - for stdout.
 
 	-r rule_path
 		Set the path to the rule file.
 
 	-n [number of routines]
 		Set the maximum number of routines running simultaneously. Default: 10
+
+	-c
+		Check the arguments and the rule file without processing anything, and report every problem,
+		located by the flag of the argument or by a JSON pointer into the array of rules loaded
+		from the rule file, such as /2/output.
+		Unknown fields, invalid conditions and regex patterns, duplicate positions,
+		and outputs unreachable after a rule without conditions are reported.
+
+	-y report_path
+		Process everything without writing outputs or the dead-letter file, and write a report
+		in JSON format to the path, or to stdout if the path is -. For each rule, the report counts
+		the records it matches in total and in each file, with a few samples of them.
+
+	-e policy
+		Set the policy of handling records not in valid JSON format. Default: fail
+		fail stops at the first invalid record, skip skips invalid records,
+		and quarantine also writes each of them with the reason to the dead-letter file.
+
+	-d dead_letter_path
+		Set the path to the dead-letter file of quarantined records.
+
+	-g[=format]
+		Compress output files by gzip, or by the format gzip or zstd given as -g=zstd, which are named
+		after their outputs with the extension .gz or .zst. Default: false
 */
 package json_select
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_condition"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"github.com/Joker-Jane/JSON-replacement/json_rules"
 	"io/fs"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
-	"regexp"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
 
+// Key of the field tagging every record written to stdout with its output
+const TagKey = "_output"
+
 // JSONSelect struct represents a JSONSelect object
 type JSONSelect struct {
 	// Configs
@@ -60,7 +95,19 @@ type JSONSelect struct {
 	rules []*Rule
 
 	// Store file pointers to output files
-	outputMap *map[string]*os.File
+	outputMap *map[string]*json_compress.File
+
+	// Stdout if the output path is -, which every output is written to with its tag
+	stdout *json_compress.File
+
+	// Handler of invalid records by the error policy
+	errors *json_error.Handler
+
+	// Records matched by the rules in dry-run mode
+	report *Report
+
+	// The first error of routines
+	first json_error.First
 }
 
 // Rule struct represents a rule object
@@ -70,32 +117,43 @@ type Rule struct {
 	Conditions []*Condition `json:"conditions"`
 }
 
-type Condition struct {
-	Type    string   `json:"type"`
-	Key     string   `json:"key"`
-	Values  []string `json:"values"`
-	Exclude bool     `json:"exclude"`
-}
+// Condition is shared with json_replace
+type Condition = json_condition.Condition
 
 // Create a NewJSONSelect Object
-func NewJSONSelect(config *Config) *JSONSelect {
+func NewJSONSelect(config *Config) (*JSONSelect, error) {
+	// Only check the arguments and the rule file in validate mode
+	if config.validate {
+		err := Validate(config)
+		if err != nil {
+			return nil, err
+		}
+		return &JSONSelect{config: config}, nil
+	}
+
 	// Check if all arguments are specified
 	if config.inputPath == "" || config.rulePath == "" || config.outputPath == "" {
-		log.Fatal("Usage: ./json_select -i input -o output -r rule [-n routines]")
+		return nil, &json_error.ConfigError{Message: "Usage: ./json_select -i input -o output -r rule [-n routines]"}
 	}
 
 	// Check if max routines is positive
 	if config.maxRoutines <= 0 {
-		log.Fatal("Error: Maximum number of routines must be greater than 0")
+		return nil, &json_error.ConfigError{Message: "Error: Maximum number of routines must be greater than 0"}
 	}
 
-	// Check if input path exists
-	_, err := os.Stat(config.inputPath)
-	if err != nil {
+	// Check if outputs can be compressed in the format
+	if err := json_compress.Check(config.compress); err != nil {
+		return nil, &json_error.ConfigError{Message: "Error: " + err.Error()}
+	}
+
+	// Check if input path exists, stdin always exists
+	var err error
+	if config.inputPath != json_compress.Stdio {
+		_, err = os.Stat(config.inputPath)
 		if errors.Is(err, os.ErrNotExist) {
-			log.Fatal("Error: Input path '" + config.inputPath + "' not found")
-		} else {
-			log.Fatal("Error: Cannot read input path '" + config.inputPath + "'")
+			return nil, &json_error.IOError{Path: config.inputPath, Message: "Error: Input path '" + config.inputPath + "' not found", Err: err}
+		} else if err != nil {
+			return nil, &json_error.IOError{Path: config.inputPath, Message: "Error: Cannot read input path '" + config.inputPath + "'", Err: err}
 		}
 	}
 
@@ -103,23 +161,29 @@ func NewJSONSelect(config *Config) *JSONSelect {
 	_, err = os.Stat(config.rulePath)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			log.Fatal("Error: Config file '" + config.rulePath + "' not found")
+			return nil, &json_error.IOError{Path: config.rulePath, Message: "Error: Config file '" + config.rulePath + "' not found", Err: err}
 		} else {
-			log.Fatal("Error: Cannot read rule file '" + config.rulePath + "'")
+			return nil, &json_error.IOError{Path: config.rulePath, Message: "Error: Cannot read rule file '" + config.rulePath + "'", Err: err}
 		}
 	}
 
-	// Read config file
-	rule, err := os.ReadFile(config.rulePath)
+	// Read config file and the files it includes
+	rule, err := json_rules.Load(config.rulePath)
 	if err != nil {
-		log.Fatal("Error: Cannot read rule file '" + config.rulePath + "'")
+		return nil, err
 	}
 
 	// Parse config file and store to rules
 	var rules []*Rule
 	err = json.Unmarshal(rule, &rules)
 	if err != nil {
-		log.Fatal("Error: Rule file must be in the format of arrays of rule json objects")
+		// Locate the problems of the rule file
+		validateErr := &json_error.ValidationError{}
+		validateRules(rule, validateErr)
+		if validateErr.Err() != nil {
+			return nil, validateErr
+		}
+		return nil, &json_error.RuleError{Message: "Error: Rule file must be in the format of arrays of rule json objects"}
 	}
 
 	// Sort the rules by position
@@ -127,63 +191,122 @@ func NewJSONSelect(config *Config) *JSONSelect {
 		return rules[i].Position < rules[j].Position
 	})
 
+	// Prepare the conditions
+	for _, r := range rules {
+		for _, c := range r.Conditions {
+			err = c.Prepare()
+			if err != nil {
+				return nil, &json_error.RuleError{Rule: r.Position, Message: "Error: " + err.Error() + " in rule " + strconv.Itoa(r.Position)}
+			}
+		}
+	}
+
+	// Nothing is written in dry-run mode, including the dead-letter file
+	policy := config.errorPolicy
+	if config.reportPath != "" && policy == json_error.Quarantine {
+		policy = json_error.Skip
+	}
+	handler, err := json_error.NewHandler(policy, config.deadLetterPath)
+	if err != nil {
+		return nil, err
+	}
+
 	// Construct JSONSelect object
 	s := &JSONSelect{
 		config:    config,
 		rules:     rules,
-		outputMap: &map[string]*os.File{},
+		outputMap: &map[string]*json_compress.File{},
+		errors:    handler,
+	}
+	if config.reportPath != "" {
+		s.report = newReport(rules)
 	}
 
-	return s
+	return s, nil
 }
 
 // Create output files from rules and store file pointers to a map
-func (s *JSONSelect) CreateOutputFiles() {
-	err := os.MkdirAll(s.config.outputPath, 0700)
-	if err != nil {
-		log.Fatal("Error: Failed to create directory '" + s.config.outputPath + "'")
+func (s *JSONSelect) CreateOutputFiles() error {
+	var err error
+	if s.config.outputPath != json_compress.Stdio {
+		err = os.MkdirAll(s.config.outputPath, 0700)
+		if err != nil {
+			return &json_error.IOError{Path: s.config.outputPath, Message: "Error: Failed to create directory '" + s.config.outputPath + "'", Err: err}
+		}
 	}
 
-	s.CreateOutputFile("default")
-	s.CreateOutputFile("drop")
+	outputs := []string{"default", "drop"}
 	for _, r := range s.rules {
-		s.CreateOutputFile(r.Output)
+		outputs = append(outputs, r.Output)
+	}
+	for _, output := range outputs {
+		err = s.CreateOutputFile(output)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-// Create a single output file
-func (s *JSONSelect) CreateOutputFile(output string) {
+// Create a single output file, or share stdout if the output path is -
+func (s *JSONSelect) CreateOutputFile(output string) error {
+	if (*s.outputMap)[output] == nil && s.config.outputPath == json_compress.Stdio {
+		if s.stdout == nil {
+			s.stdout, _ = json_compress.Create(json_compress.Stdio, s.config.compress)
+		}
+		(*s.outputMap)[output] = s.stdout
+	}
 	if (*s.outputMap)[output] == nil {
+		// Outputs are named as they are given, with the extension of compression if they are compressed
 		p := filepath.Join(s.config.outputPath, output)
-		f, err := os.Create(p)
+		if s.config.compress != "" {
+			p = json_compress.Target(p, s.config.compress)
+		}
+		f, err := json_compress.Create(p, s.config.compress)
 		if err != nil {
-			log.Fatal("Error: Failed to create file '" + p + "'")
+			return &json_error.IOError{Path: p, Message: "Error: Failed to create file '" + p + "'", Err: err}
 		}
 		(*s.outputMap)[output] = f
 	}
+	return nil
 }
 
 // Close output files
-func (s *JSONSelect) CloseOutputFiles() {
-	for output, f := range *s.outputMap {
+func (s *JSONSelect) CloseOutputFiles() error {
+	var closeErr error
+	for _, f := range *s.outputMap {
 		err := f.Close()
-		if err != nil {
-			log.Fatal("Error: Failed to close file '" +
-				filepath.Join(s.config.outputPath, output) + "'")
+		if err != nil && closeErr == nil {
+			p := f.Name()
+			closeErr = &json_error.IOError{Path: p, Message: "Error: Failed to close file '" + p + "'", Err: err}
 		}
 	}
+	return closeErr
 }
 
 // Execute
-func (s *JSONSelect) Exec() {
+// Return the first error, records not in valid JSON format are handled by the error policy
+func (s *JSONSelect) Exec() error {
+	// Nothing is processed in validate mode
+	if s.config.validate {
+		log.Printf("Success: Rule file '%s' is valid\n", s.config.rulePath)
+		return nil
+	}
+
 	// Record start time
 	startTime := time.Now()
 
 	// Record record count
 	count := 0
 
-	// Create outputs files
-	s.CreateOutputFiles()
+	// Create outputs files, which are not created in dry-run mode
+	var err error
+	if s.report == nil {
+		err = s.CreateOutputFiles()
+		if err != nil {
+			return err
+		}
+	}
 
 	// Limit the max number of goroutines running simultaneously
 	ch := make(chan int, s.config.maxRoutines)
@@ -191,36 +314,85 @@ func (s *JSONSelect) Exec() {
 	// Handle synchronization
 	var wg sync.WaitGroup
 
-	// Walk through and process the input file tree
-	err := filepath.WalkDir(s.config.inputPath, func(path string, d fs.DirEntry, err error) error {
-		if !d.IsDir() {
-			count += s.handleFile(path, ch, &wg)
+	// Process a single file
+	visit := func(path string) error {
+		if s.report != nil {
+			s.report.addFile()
 		}
+		n, err := s.handleFile(path, ch, &wg)
+		count += n
 		return err
-	})
-	if err != nil {
-		log.Fatal("Error: Failed to walk through the input directory")
+	}
+
+	// Process stdin as a single file, or walk through and process the input file tree
+	var walkErr error
+	if s.config.inputPath == json_compress.Stdio {
+		walkErr = visit(json_compress.Stdio)
+	} else {
+		walkErr = filepath.WalkDir(s.config.inputPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Stop assigning records once a routine fails
+			if s.first.Get() != nil {
+				return errStopped
+			}
+			if !d.IsDir() {
+				return visit(path)
+			}
+			return nil
+		})
 	}
 
 	// Wait until all routines finish
 	wg.Wait()
 
 	// Close output files
-	s.CloseOutputFiles()
+	closeErr := s.CloseOutputFiles()
+	handlerErr := s.errors.Close()
+
+	// Return the first error of routines before errors of walking and closing
+	if err = s.first.Get(); err != nil {
+		return err
+	}
+	if walkErr != nil && walkErr != errStopped {
+		if _, ok := walkErr.(*json_error.IOError); ok {
+			return walkErr
+		}
+		return &json_error.IOError{Path: s.config.inputPath, Message: "Error: Failed to walk through the input directory", Err: walkErr}
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if handlerErr != nil {
+		return handlerErr
+	}
+
+	// Write the report instead of outputs in dry-run mode
+	if s.report != nil {
+		err = s.report.write(s.config.reportPath, s.errors.Skipped())
+		if err != nil {
+			return err
+		}
+	}
 
 	// Log output
-	log.Printf("Success: Processed %d records(s) in %.4f second(s)\n",
-		count, time.Since(startTime).Seconds())
+	log.Printf("Success: Processed %d records(s) and skipped %d invalid record(s) in %.4f second(s)\n",
+		count-s.errors.Skipped(), s.errors.Skipped(), time.Since(startTime).Seconds())
+	return nil
 }
 
+// Returned by the walk function to stop walking once a routine fails
+var errStopped = errors.New("stopped")
+
 // Handle input json file
-func (s *JSONSelect) handleFile(filePath string, ch chan int, wg *sync.WaitGroup) int {
+func (s *JSONSelect) handleFile(filePath string, ch chan int, wg *sync.WaitGroup) (int, error) {
 	// Open the input file
-	f, err := os.Open(filePath)
-	defer f.Close()
+	f, err := json_compress.Open(filePath)
 	if err != nil {
-		log.Fatal("Error: Cannot read input file '" + filePath + "'")
+		return 0, &json_error.IOError{Path: filePath, Message: "Error: Cannot read input file '" + filePath + "'", Err: err}
 	}
+	defer f.Close()
 
 	scanner := bufio.NewScanner(f)
 
@@ -238,6 +410,11 @@ func (s *JSONSelect) handleFile(filePath string, ch chan int, wg *sync.WaitGroup
 			continue
 		}
 
+		// Stop reading once a routine fails
+		if s.first.Get() != nil {
+			break
+		}
+
 		// Copy from scanner to a new slice to allocate memory
 		bytes := make([]byte, len(scanner.Bytes()))
 		copy(bytes, scanner.Bytes())
@@ -248,13 +425,17 @@ func (s *JSONSelect) handleFile(filePath string, ch chan int, wg *sync.WaitGroup
 		wg.Add(1)
 		go s.startRoutine(&bytes, ch, filePath, line, wg)
 	}
+	if err = scanner.Err(); err != nil {
+		return count, &json_error.IOError{Path: filePath, Message: "Error: Cannot read input file '" + filePath + "'", Err: err}
+	}
+
 	// return count of processed records
-	return count
+	return count, nil
 }
 
 // Start a goroutine to handle a single record
 func (s *JSONSelect) startRoutine(input *[]byte, ch chan int, filePath string, line int, wg *sync.WaitGroup) {
-	s.handleJSON(input, filePath, line)
+	s.first.Set(s.handleJSON(input, filePath, line))
 
 	// Finish the routine
 	wg.Done()
@@ -262,136 +443,76 @@ func (s *JSONSelect) startRoutine(input *[]byte, ch chan int, filePath string, l
 }
 
 // Handle a single JSON object
-func (s *JSONSelect) handleJSON(input *[]byte, filePath string, line int) {
-	// Parse input json
+func (s *JSONSelect) handleJSON(input *[]byte, filePath string, line int) error {
+	// Parse input json, skip the record unless the error policy fails fast
 	var v interface{}
 	err := json.Unmarshal(*input, &v)
 	if err != nil {
-		if errors.Is(&json.SyntaxError{}, err) {
-			log.Fatal("Error: Line " + strconv.Itoa(line) + " of '" + filePath + "' is not in valid JSON format")
-		} else {
-			log.Fatal(err)
-		}
+		return s.errors.Handle(&json_error.JSONError{File: filePath, Line: line, Err: err}, *input)
 	}
 
 	// Apply every rule on files, stop if match any rule
-	for _, r := range s.rules {
-		// If all conditions are met, write to specific output
+	for i, r := range s.rules {
+		// If all conditions are met, write to specific output, or only report it in dry-run mode
 		if s.processRule(v, *r) {
-			s.write(input, r.Output)
-			return
+			if s.report != nil {
+				s.report.add(i, *input, filePath, line)
+				return nil
+			}
+			return s.write(input, r.Output)
 		}
 	}
 
 	// If no rule is met, send to default
-	s.write(input, "default")
+	if s.report != nil {
+		s.report.add(-1, *input, filePath, line)
+		return nil
+	}
+	return s.write(input, "default")
 }
 
 // Return if all conditions in the rule is met
 func (s *JSONSelect) processRule(v interface{}, r Rule) bool {
-	for _, c := range r.Conditions {
-		if !s.processCondition(v, c) {
-			return false
-		}
-	}
-	return true
-}
-
-// Return if the condition is met
-func (s *JSONSelect) processCondition(v interface{}, c *Condition) bool {
-	return s.process("", v, c) != c.Exclude
-}
-
-// Process non-string elements
-func (s *JSONSelect) process(k string, v interface{}, c *Condition) bool {
-	switch v.(type) {
-	case map[string]interface{}:
-		return s.processMap(v.(map[string]interface{}), c)
-	case []interface{}:
-		return s.processArray(v.([]interface{}), k, c)
-	}
-	return false
-}
-
-// Process maps
-func (s *JSONSelect) processMap(m map[string]interface{}, c *Condition) bool {
-	k, next, _ := strings.Cut(c.Key, ".")
-	v, found := m[k]
-	if found {
-		switch v.(type) {
-		case string:
-			if next == "" {
-				return s.test(v.(string), c)
-			}
-		default:
-			c.Key = next
-			return s.process(k, v, c)
-		}
-	}
-	return false
-}
-
-// Process arrays
-func (s *JSONSelect) processArray(a []interface{}, k string, c *Condition) bool {
-	for _, v := range a {
-		switch v.(type) {
-		case string:
-			if k == "" {
-				return s.test(v.(string), c)
-			}
-		default:
-			return s.process(k, v, c)
-		}
-	}
-	return false
-}
-
-// Test if the field matches the condition
-func (s *JSONSelect) test(v string, c *Condition) bool {
-	for _, value := range c.Values {
-		switch c.Type {
-		case "match":
-			if v == value {
-				return true
-			}
-			break
-		case "prefix":
-			if strings.HasPrefix(v, value) {
-				return true
-			}
-			break
-		case "suffix":
-			if strings.HasSuffix(v, value) {
-				return true
-			}
-			break
-		case "exist":
-			return true
-		case "regex":
-			// Match regex pattern, parsing error is ignored and return false
-			m, _ := regexp.MatchString(value, v)
-			if m {
-				return true
-			}
-			break
-		default:
-			log.Fatal("Error: Invalid condition type '" + c.Type + "'")
-		}
-	}
-	return false
+	return json_condition.MatchAll(r.Conditions, v)
 }
 
 // Write to the output file
-func (s *JSONSelect) write(json *[]byte, output string) {
+func (s *JSONSelect) write(json *[]byte, output string) error {
 	// Get the file pointer from map
 	f := (*s.outputMap)[output]
 
+	// Tag the record by its output on stdout
+	if s.stdout != nil {
+		*json = tag(*json, output)
+	}
+
 	// Append a new line character
 	*json = append(*json, byte('\n'))
 
 	// Write to file, internally thread safe
 	_, err := f.Write(*json)
 	if err != nil {
-		log.Fatal("Error: Failed to write to '" + path.Join(s.config.outputPath, output) + "'")
+		p := f.Name()
+		return &json_error.IOError{Path: p, Message: "Error: Failed to write to '" + p + "'", Err: err}
+	}
+	return nil
+}
+
+// Return the record with the tag of its output as its first field, or as it is if it is not an object
+// The rest of the record is kept byte for byte
+func tag(record []byte, output string) []byte {
+	trimmed := bytes.TrimLeft(record, " \t\r")
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return record
+	}
+	key, _ := json.Marshal(TagKey)
+	value, _ := json.Marshal(output)
+
+	tagged := append([]byte{'{'}, key...)
+	tagged = append(tagged, ':')
+	tagged = append(tagged, value...)
+	if rest := bytes.TrimLeft(trimmed[1:], " \t\r\n"); len(rest) > 0 && rest[0] != '}' {
+		tagged = append(tagged, ',')
 	}
+	return append(tagged, trimmed[1:]...)
 }
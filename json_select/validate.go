@@ -0,0 +1,118 @@
+package json_select
+
+import (
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_condition"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
+	"github.com/Joker-Jane/JSON-replacement/json_rules"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Check the arguments and the rule file without processing anything
+// Return a ValidationError reporting every problem, or nil if there is none
+func Validate(config *Config) error {
+	e := &json_error.ValidationError{}
+
+	if config.inputPath != json_compress.Stdio {
+		e.CheckInput("-i", config.inputPath)
+	}
+	if config.outputPath != json_compress.Stdio {
+		e.CheckOutput("-o", config.outputPath, true)
+	}
+	if config.reportPath != "" && config.reportPath != "-" {
+		e.CheckOutput("-y", config.reportPath, false)
+	}
+	if config.maxRoutines <= 0 {
+		e.AddFlag("-n", "Maximum number of routines must be greater than 0")
+	}
+	e.CheckPolicy(config.errorPolicy, config.deadLetterPath)
+	if err := json_compress.Check(config.compress); err != nil {
+		e.AddFlagError("-g", err)
+	}
+
+	if config.rulePath == "" {
+		e.AddFlag("-r", "Rule path must be specified")
+		return e.Err()
+	}
+	content, err := json_rules.Load(config.rulePath)
+	if err != nil {
+		if _, ok := err.(*json_error.IOError); ok {
+			e.AddFlagError("-r", err)
+		} else {
+			e.Add("", strings.TrimPrefix(err.Error(), "Error: "))
+		}
+		return e.Err()
+	}
+	validateRules(content, e)
+	return e.Err()
+}
+
+// validRule struct records a rule decoded by validation, its JSON pointer and its number of conditions
+type validRule struct {
+	*Rule
+	pointer    string
+	conditions int
+}
+
+// Validate every rule of a rule file
+func validateRules(content []byte, e *json_error.ValidationError) {
+	values, ok := json_error.ParseRules(content, e)
+	if !ok {
+		return
+	}
+
+	var rules []validRule
+	positions := map[int]string{}
+	for i, v := range values {
+		p := json_error.Pointer("", i)
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			e.Add(p, "Rule must be an object")
+			continue
+		}
+		json_condition.Validate(json_error.Pointer(p, "conditions"), object["conditions"], e)
+		r := &Rule{}
+		if !e.CheckFields(p, object, r, "conditions") {
+			continue
+		}
+		conditions, _ := object["conditions"].([]interface{})
+		rules = append(rules, validRule{Rule: r, pointer: p, conditions: len(conditions)})
+
+		// Rules of the same position are tested in an undefined order
+		if first, found := positions[r.Position]; found {
+			e.Add(json_error.Pointer(p, "position"), "Duplicate position "+strconv.Itoa(r.Position)+" of the rule at "+strconv.Quote(first))
+		} else {
+			positions[r.Position] = p
+		}
+
+		// The output must be a file in the output directory
+		output := filepath.Clean(r.Output)
+		if r.Output == "" || filepath.IsAbs(output) || output == ".." || strings.HasPrefix(output, ".."+string(filepath.Separator)) {
+			e.Add(json_error.Pointer(p, "output"), "Output '"+r.Output+"' must be a file name in the output directory")
+		}
+	}
+
+	// Rules after a rule without conditions are never tested, since it matches every record
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Position < rules[j].Position
+	})
+	reachable := map[string]bool{"default": true}
+	catchAll := ""
+	for _, r := range rules {
+		if catchAll == "" {
+			reachable[r.Output] = true
+			if r.conditions == 0 {
+				catchAll = r.pointer
+			}
+			continue
+		}
+		if reachable[r.Output] {
+			e.Add(r.pointer, "Rule is unreachable, since the rule at "+strconv.Quote(catchAll)+" matches every record")
+		} else {
+			e.Add(json_error.Pointer(r.pointer, "output"), "Output '"+r.Output+"' is unreachable, since the rule at "+strconv.Quote(catchAll)+" matches every record")
+		}
+	}
+}
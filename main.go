@@ -2,10 +2,17 @@ package main
 
 import (
 	"github.com/Joker-Jane/JSON-replacement/json_flat"
+	"log"
 )
 
 func main() {
 	cfg := json_flat.NewConfigFromConsole()
-	s := json_flat.NewJSONFlat(cfg)
-	s.Exec()
+	s, err := json_flat.NewJSONFlat(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = s.Exec()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
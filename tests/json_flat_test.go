@@ -10,8 +10,14 @@ func TestFlatSingleFile(t *testing.T) {
 	outputPath := "json_flat_tests/case1/output.json"
 
 	cfg := json_flat.NewDefaultConfig(inputPath, outputPath)
-	flat := json_flat.NewJSONFlat(cfg)
-	flat.Exec()
+	flat, err := json_flat.NewJSONFlat(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = flat.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestFlatSingleFileWithMultipleLines(t *testing.T) {
@@ -19,8 +25,14 @@ func TestFlatSingleFileWithMultipleLines(t *testing.T) {
 	outputPath := "json_flat_tests/case2/output.json"
 
 	cfg := json_flat.NewDefaultConfig(inputPath, outputPath)
-	flat := json_flat.NewJSONFlat(cfg)
-	flat.Exec()
+	flat, err := json_flat.NewJSONFlat(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = flat.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestFlatMultipleFiles(t *testing.T) {
@@ -28,8 +40,14 @@ func TestFlatMultipleFiles(t *testing.T) {
 	outputPath := "json_flat_tests/case3/outputs"
 
 	cfg := json_flat.NewDefaultConfig(inputPath, outputPath)
-	flat := json_flat.NewJSONFlat(cfg)
-	flat.Exec()
+	flat, err := json_flat.NewJSONFlat(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = flat.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestComplex(t *testing.T) {
@@ -37,6 +55,12 @@ func TestComplex(t *testing.T) {
 	outputPath := "json_flat_tests/case4/outputs"
 
 	cfg := json_flat.NewDefaultConfig(inputPath, outputPath)
-	flat := json_flat.NewJSONFlat(cfg)
-	flat.Exec()
+	flat, err := json_flat.NewJSONFlat(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = flat.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
@@ -1,8 +1,24 @@
 package tests
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
 	"github.com/Joker-Jane/JSON-replacement/json_replace"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Test a single file with standard input
@@ -12,8 +28,14 @@ func TestReplaceSingleFile(t *testing.T) {
 	rulePath := "json_replace_tests/case1/rules.json"
 
 	cfg := json_replace.NewDefaultConfig(inputPath, outputPath, rulePath)
-	replace := json_replace.NewJSONReplace(cfg)
-	replace.Exec()
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 // Test multiple files in a directory
@@ -23,8 +45,14 @@ func TestReplaceDirectory(t *testing.T) {
 	rulePath := "json_replace_tests/case2/rules.json"
 
 	cfg := json_replace.NewDefaultConfig(inputPath, outputPath, rulePath)
-	replace := json_replace.NewJSONReplace(cfg)
-	replace.Exec()
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 /*
@@ -35,8 +63,14 @@ func TestReplaceMassive(t *testing.T) {
 	rulePath := "json_replace_tests/case4/rules.json"
 
 	cfg := json_replace.NewDefaultConfig(inputPath, outputPath, rulePath)
-	replace := json_replace.NewJSONReplace(cfg)
-	replace.Exec()
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 */
 
@@ -47,8 +81,14 @@ func TestReplaceLineByLine(t *testing.T) {
 	rulePath := "json_replace_tests/case3/rules.json"
 
 	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
-	replace := json_replace.NewJSONReplace(cfg)
-	replace.Exec()
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 // Test multiple files in a directory
@@ -58,6 +98,1339 @@ func TestReplaceTimestamp(t *testing.T) {
 	rulePath := "json_replace_tests/case5/rules.json"
 
 	cfg := json_replace.NewDefaultConfig(inputPath, outputPath, rulePath)
-	replace := json_replace.NewJSONReplace(cfg)
-	replace.Exec()
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test regex rules with capture groups in line-by-line mode
+func TestReplaceRegex(t *testing.T) {
+	inputPath := "json_replace_tests/case6/input.txt"
+	outputPath := "json_replace_tests/case6/output.txt"
+	rulePath := "json_replace_tests/case6/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareOutput(t, outputPath, "json_replace_tests/case6/expected.txt")
+}
+
+// Test hash rules across multiple files in line-by-line mode
+func TestReplaceHash(t *testing.T) {
+	inputPath := "json_replace_tests/case7/inputs"
+	outputPath := "json_replace_tests/case7/outputs"
+	rulePath := "json_replace_tests/case7/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same user has the same pseudonym in both files
+	for _, name := range []string{"input1.txt", "input2.txt"} {
+		compareOutput(t, outputPath+"/"+name, "json_replace_tests/case7/expected/"+name)
+	}
+}
+
+// Test detect rules with built-in detectors in line-by-line mode
+func TestReplaceDetect(t *testing.T) {
+	inputPath := "json_replace_tests/case8/input.txt"
+	outputPath := "json_replace_tests/case8/output.txt"
+	rulePath := "json_replace_tests/case8/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cards failing the Luhn checksum, SSNs never assigned, IPv4 addresses out of range,
+	// and IPv6 lookalikes such as std::vector and ::1 are kept
+	compareOutput(t, outputPath, "json_replace_tests/case8/expected.txt")
+}
+
+// Test tokenize rules and restore the tokens from the vault
+func TestReplaceTokenize(t *testing.T) {
+	inputPath := "json_replace_tests/case9/input.txt"
+	outputPath := "json_replace_tests/case9/output.txt"
+	rulePath := "json_replace_tests/case9/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenized, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(tokenized, []byte("alice")) || bytes.Contains(tokenized, []byte("4111111111111111")) {
+		t.Fatalf("expected tokenized values, got %s", tokenized)
+	}
+
+	// Values are replaced with random tokens of their prefixes, and the same value has the same token
+	token := regexp.MustCompile(`^(user|tok)_[0-9a-f]{16}$`)
+	records := readRecords(t, outputPath)
+	for _, record := range records {
+		m := record.(map[string]interface{})
+		card := m["card"].(map[string]interface{})
+		for _, v := range []interface{}{m["user"], card["number"], card["cvv"]} {
+			if s, ok := v.(string); !ok || !token.MatchString(s) {
+				t.Fatalf("expected a token, got %v", v)
+			}
+		}
+	}
+	first, second, third := records[0].(map[string]interface{}), records[1].(map[string]interface{}), records[2].(map[string]interface{})
+	if !reflect.DeepEqual(first["card"], third["card"]) || first["user"] != third["user"] {
+		t.Fatalf("expected the same tokens of the same values, got %v and %v", first, third)
+	}
+	if first["user"] == second["user"] || reflect.DeepEqual(first["card"], second["card"]) {
+		t.Fatalf("expected different tokens of different values, got %v and %v", first, second)
+	}
+
+	// The vault starts with its header, and is replaced without leaving temporary files
+	vaultPath := "json_replace_tests/case9/output.vault"
+	vault, err := os.ReadFile(vaultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(vault, []byte("JRVAULT1")) {
+		t.Fatalf("expected the header of the vault")
+	}
+	temporary, _ := filepath.Glob("json_replace_tests/case9/.output.vault.*")
+	if len(temporary) != 0 {
+		t.Fatalf("expected no temporary vault files, got %v", temporary)
+	}
+
+	// The vault is reopened with its salt, so that the same values have the same tokens
+	cfg = json_replace.NewConfig(inputPath, "json_replace_tests/case9/output_again.txt", rulePath, true, 10)
+	replace, err = json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareOutput(t, "json_replace_tests/case9/output_again.txt", outputPath)
+
+	// Tokenized values are restored by detokenize mode, and the vault cannot be opened with another key
+	cfg = json_replace.NewConfig(outputPath, "json_replace_tests/case9/output_restored.txt", "", true, 10)
+	cfg.SetMode(json_replace.ModeDetokenize)
+	cfg.SetVault(vaultPath, "wrong-key")
+	_, err = json_replace.NewJSONReplace(cfg)
+	var ioErr *json_error.IOError
+	if !errors.As(err, &ioErr) {
+		t.Fatalf("expected an error of decrypting the vault with a wrong key, got %v", err)
+	}
+
+	cfg.SetVault(vaultPath, "change-me")
+	detokenize, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = detokenize.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restored records are the input records
+	expected := readRecords(t, inputPath)
+	restored := readRecords(t, "json_replace_tests/case9/output_restored.txt")
+	if !reflect.DeepEqual(restored, expected) {
+		t.Fatalf("expected restored records %v, got %v", expected, restored)
+	}
+}
+
+// Test remove and drop-record rules in line-by-line mode
+func TestReplaceRemove(t *testing.T) {
+	inputPath := "json_replace_tests/case10/input.txt"
+	outputPath := "json_replace_tests/case10/output.txt"
+	rulePath := "json_replace_tests/case10/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The healthcheck record is dropped without leaving an empty line
+	compareOutput(t, outputPath, "json_replace_tests/case10/expected.txt")
+}
+
+// Test numeric and set rules in line-by-line mode
+func TestReplaceNumeric(t *testing.T) {
+	inputPath := "json_replace_tests/case11/input.txt"
+	outputPath := "json_replace_tests/case11/output.txt"
+	rulePath := "json_replace_tests/case11/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Noise of a fixed seed is the same in every run
+	compareOutput(t, outputPath, "json_replace_tests/case11/expected.txt")
+}
+
+// Test noise derived from each value, which is the same in every file and with any number of routines
+func TestReplaceNoise(t *testing.T) {
+	inputPath := "json_replace_tests/case11/inputs"
+	rulePath := "json_replace_tests/case11/rules_noise.json"
+
+	salaries := map[string]interface{}{}
+	for _, routines := range []int{1, 10} {
+		outputPath := "json_replace_tests/case11/outputs_" + strconv.Itoa(routines)
+		cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, routines)
+		replace, err := json_replace.NewJSONReplace(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = replace.Exec()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Both files have the same records in different orders
+		for _, name := range []string{"a.txt", "b.txt"} {
+			for _, record := range readRecords(t, outputPath+"/"+name) {
+				m := record.(map[string]interface{})
+				user := m["name"].(string)
+				if salary, found := salaries[user]; found && salary != m["salary"] {
+					t.Fatalf("expected the same noise of %s in every file and run, got %v and %v", user, salary, m["salary"])
+				}
+				salaries[user] = m["salary"]
+			}
+		}
+	}
+	if salaries["bob"] == 51000.0 {
+		t.Fatalf("expected noise of the salary of bob, got %v", salaries["bob"])
+	}
+}
+
+// Test date-shift and date-truncate rules in line-by-line mode
+func TestReplaceDate(t *testing.T) {
+	inputPath := "json_replace_tests/case12/input.txt"
+	outputPath := "json_replace_tests/case12/output.txt"
+	rulePath := "json_replace_tests/case12/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareOutput(t, outputPath, "json_replace_tests/case12/expected.txt")
+
+	// Every date of the same patient is shifted by the same days in every record
+	inputs, outputs := readRecords(t, inputPath), readRecords(t, outputPath)
+	shift := func(i int, field string) time.Duration {
+		original, err := time.Parse(time.RFC3339, inputs[i].(map[string]interface{})[field].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shifted, err := time.Parse(time.RFC3339, outputs[i].(map[string]interface{})[field].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return shifted.Sub(original)
+	}
+	days := shift(0, "admitted")
+	if days == 0 || days%(24*time.Hour) != 0 {
+		t.Fatalf("expected a shift of whole days, got %v", days)
+	}
+	for _, s := range []time.Duration{shift(0, "discharged"), shift(2, "admitted"), shift(2, "discharged")} {
+		if s != days {
+			t.Fatalf("expected every date of the patient to be shifted by %v, got %v", days, s)
+		}
+	}
+}
+
+// Test ip rules in truncate and prefix-preserving modes in line-by-line mode
+func TestReplaceIP(t *testing.T) {
+	inputPath := "json_replace_tests/case13/input.txt"
+	outputPath := "json_replace_tests/case13/output.txt"
+	rulePath := "json_replace_tests/case13/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareOutput(t, outputPath, "json_replace_tests/case13/expected.txt")
+
+	// Anonymized addresses share as many leading bits as the original addresses
+	inputs, outputs := readRecords(t, inputPath), readRecords(t, outputPath)
+	source := func(records []interface{}, i int) string {
+		return records[i].(map[string]interface{})["src_ip"].(string)
+	}
+	for _, pair := range [][2]int{{0, 1}, {2, 3}} {
+		original := commonPrefix(source(inputs, pair[0]), source(inputs, pair[1]))
+		anonymized := commonPrefix(source(outputs, pair[0]), source(outputs, pair[1]))
+		if original != anonymized {
+			t.Fatalf("expected %d common leading bits of records %v, got %d", original, pair, anonymized)
+		}
+	}
+}
+
+// Test wildcard, recursive, index, slice and quoted path selectors in line-by-line mode
+func TestReplacePath(t *testing.T) {
+	inputPath := "json_replace_tests/case14/input.txt"
+	outputPath := "json_replace_tests/case14/output.txt"
+	rulePath := "json_replace_tests/case14/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareOutput(t, outputPath, "json_replace_tests/case14/expected.txt")
+}
+
+// Test key-name rules with globs and regex in line-by-line mode
+func TestReplaceKeyName(t *testing.T) {
+	inputPath := "json_replace_tests/case15/input.txt"
+	outputPath := "json_replace_tests/case15/output.txt"
+	rulePath := "json_replace_tests/case15/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are matched regardless of case, and matched objects are replaced as a whole
+	compareOutput(t, outputPath, "json_replace_tests/case15/expected.txt")
+}
+
+// Test rules with when conditions in line-by-line mode
+func TestReplaceWhen(t *testing.T) {
+	inputPath := "json_replace_tests/case16/input.txt"
+	outputPath := "json_replace_tests/case16/output.txt"
+	rulePath := "json_replace_tests/case16/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rules are only applied to the records meeting all of their conditions
+	compareOutput(t, outputPath, "json_replace_tests/case16/expected.txt")
+}
+
+// Test stream mode with top-level arrays and arrays in top-level objects
+func TestReplaceStream(t *testing.T) {
+	inputPath := "json_replace_tests/case17/inputs"
+	outputPath := "json_replace_tests/case17/outputs"
+	rulePath := "json_replace_tests/case17/rules.json"
+
+	cfg := json_replace.NewDefaultConfig(inputPath, outputPath, rulePath)
+	cfg.SetStream(true)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Elements of the top-level array are records by themselves, and elements of arrays in the top-level object
+	// are parts of the whole record
+	for _, name := range []string{"export.json", "report.json"} {
+		compareOutput(t, outputPath+"/"+name, "json_replace_tests/case17/expected/"+name)
+	}
+}
+
+// Test stream mode writing the same objects as the whole documents with record-level rules,
+// conditions and entities on the rest of the record, in both normal and faithful mode
+func TestReplaceStreamObject(t *testing.T) {
+	inputPath := "json_replace_tests/case31/inputs"
+	rulePath := "json_replace_tests/case31/rules.json"
+
+	for _, faithful := range []bool{false, true} {
+		outputPaths := []string{"json_replace_tests/case31/outputs", "json_replace_tests/case31/outputs_stream"}
+		for i, outputPath := range outputPaths {
+			cfg := json_replace.NewDefaultConfig(inputPath, outputPath, rulePath)
+			cfg.SetStream(i == 1)
+			cfg.SetFaithful(faithful, false)
+			replace, err := json_replace.NewJSONReplace(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = replace.Exec()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, name := range []string{"acme.json", "globex.json"} {
+			compareOutput(t, outputPaths[1]+"/"+name, outputPaths[0]+"/"+name)
+		}
+
+		// Nested keys keep their order and strings keep their escaping in faithful mode
+		if faithful {
+			acme, err := os.ReadFile(outputPaths[1] + "/acme.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(acme, []byte(`"meta":{"b":"<x>","a":1.50,"note":"caf\u00e9"},"label":"\u003cacme\u003e"`)) {
+				t.Fatalf("expected members written as in the input, got %s", acme)
+			}
+		}
+		for _, name := range []string{"healthcheck.json", "purge.json"} {
+			for _, outputPath := range outputPaths {
+				if _, err := os.Stat(outputPath + "/" + name); !errors.Is(err, os.ErrNotExist) {
+					t.Fatalf("expected %s/%s to be dropped", outputPath, name)
+				}
+			}
+		}
+		for _, outputPath := range outputPaths {
+			os.RemoveAll(outputPath)
+		}
+	}
+}
+
+// Test faithful mode keeping key order, number literals, string escaping and whitespace,
+// including numbers not matched by set rules
+func TestReplaceFaithful(t *testing.T) {
+	inputPath := "json_replace_tests/case18/inputs/record.json"
+	outputPath := "json_replace_tests/case18/output.json"
+	rulePath := "json_replace_tests/case18/rules.json"
+
+	cfg := json_replace.NewDefaultConfig(inputPath, outputPath, rulePath)
+	cfg.SetFaithful(true, true)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareOutput(t, outputPath, "json_replace_tests/case18/expected.json")
+
+	inputPath = "json_replace_tests/case18/inputs/records.txt"
+	outputPath = "json_replace_tests/case18/output.txt"
+
+	cfg = json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	cfg.SetFaithful(true, false)
+	replace, err = json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareOutput(t, outputPath, "json_replace_tests/case18/expected.txt")
+}
+
+// Test faithful mode adding members to objects without members left from the input
+func TestReplaceFaithfulAdded(t *testing.T) {
+	inputPath := "json_replace_tests/case33/input.txt"
+	rulePath := "json_replace_tests/case33/rules.json"
+
+	for _, whitespace := range []bool{false, true} {
+		outputPath := "json_replace_tests/case33/output.txt"
+		expectedPath := "json_replace_tests/case33/expected.txt"
+		if whitespace {
+			outputPath = "json_replace_tests/case33/output_whitespace.txt"
+			expectedPath = "json_replace_tests/case33/expected_whitespace.txt"
+		}
+		cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 1)
+		cfg.SetFaithful(true, whitespace)
+		replace, err := json_replace.NewJSONReplace(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = replace.Exec()
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareOutput(t, outputPath, expectedPath)
+	}
+}
+
+// Test quarantine policy writing invalid lines to the dead-letter file in line-by-line mode
+func TestReplaceQuarantine(t *testing.T) {
+	inputPath := "json_replace_tests/case19/input.txt"
+	outputPath := "json_replace_tests/case19/output.txt"
+	rulePath := "json_replace_tests/case19/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	cfg.SetErrorPolicy(json_error.Quarantine, "json_replace_tests/case19/output_dead_letter.txt")
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Valid records are still replaced, and only the invalid ones are skipped
+	compareOutput(t, outputPath, "json_replace_tests/case19/expected.txt")
+	if replace.Skipped() != 2 {
+		t.Fatalf("expected 2 skipped records, got %d", replace.Skipped())
+	}
+
+	// The dead-letter file holds every invalid record with its file, line and reason
+	expected := []json_error.Entry{
+		{File: inputPath, Line: 2, Record: `{"name": "bob", "email": "bob@example.com"`},
+		{File: inputPath, Line: 4, Record: "not a record"},
+	}
+	entries := readRecords(t, "json_replace_tests/case19/output_dead_letter.txt")
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d dead-letter entries, got %v", len(expected), entries)
+	}
+	for i, e := range entries {
+		m := e.(map[string]interface{})
+		reason, _ := m["reason"].(string)
+		if m["file"] != expected[i].File || m["line"] != float64(expected[i].Line) || m["record"] != expected[i].Record || reason == "" {
+			t.Fatalf("expected dead-letter entry %+v with a reason, got %v", expected[i], m)
+		}
+	}
+}
+
+// Test fail-fast policy returning the line of the first invalid record
+func TestReplaceFailFast(t *testing.T) {
+	inputPath := "json_replace_tests/case19/input.txt"
+	outputPath := "json_replace_tests/case19/output_fail.txt"
+	rulePath := "json_replace_tests/case19/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	var jsonErr *json_error.JSONError
+	if !errors.As(err, &jsonErr) || jsonErr.Line != 2 {
+		t.Fatal("expected invalid JSON at line 2, got", err)
+	}
+
+	// The line of a document is the line of its syntax error
+	inputPath = "json_replace_tests/case19/document.json"
+	outputPath = "json_replace_tests/case19/output_document.json"
+	for _, stream := range []bool{false, true} {
+		for _, faithful := range []bool{false, true} {
+			cfg = json_replace.NewConfig(inputPath, outputPath, rulePath, false, 1)
+			cfg.SetStream(stream)
+			cfg.SetFaithful(faithful, false)
+			replace, err = json_replace.NewJSONReplace(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = replace.Exec()
+			if !errors.As(err, &jsonErr) || jsonErr.Line != 4 {
+				t.Fatalf("expected invalid JSON at line 4 with stream %v and faithful %v, got %v", stream, faithful, err)
+			}
+		}
+	}
+}
+
+// Test timestamp rules with auto, epoch and custom formats and timezones in line-by-line mode
+func TestReplaceTimestampFormat(t *testing.T) {
+	inputPath := "json_replace_tests/case20/input.txt"
+	outputPath := "json_replace_tests/case20/output.txt"
+	rulePath := "json_replace_tests/case20/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 1)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Timestamps keep the representation of the original values, including epoch strings, timezone offsets
+	// and date-only layouts, and missing fields are written in epoch milliseconds
+	compareOutput(t, outputPath, "json_replace_tests/case20/expected.txt")
+}
+
+// Test timestamp rules with preserve, poisson, bursty and diurnal profiles in line-by-line mode
+func TestReplaceTimestampProfile(t *testing.T) {
+	inputPath := "json_replace_tests/case21/input.txt"
+	outputPath := "json_replace_tests/case21/output.txt"
+	rulePath := "json_replace_tests/case21/rules.json"
+
+	for _, path := range []string{outputPath, "json_replace_tests/case21/output_again.txt"} {
+		cfg := json_replace.NewConfig(inputPath, path, rulePath, true, 1)
+		replace, err := json_replace.NewJSONReplace(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = replace.Exec()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Random profiles of the same seeds generate the same timestamps in every run
+	compareOutput(t, "json_replace_tests/case21/output_again.txt", outputPath)
+
+	// Timestamps of every profile never go back
+	records := readRecords(t, outputPath)
+	previous := map[string]time.Time{}
+	for _, record := range records {
+		m := record.(map[string]interface{})
+		times := map[string]time.Time{"time": time.Unix(int64(m["time"].(float64)), 0)}
+		for _, field := range []string{"poisson", "bursty", "diurnal"} {
+			parsed, err := time.Parse(time.RFC3339, m[field].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			times[field] = parsed
+		}
+		for field, parsed := range times {
+			if parsed.Before(previous[field]) {
+				t.Fatalf("expected non-decreasing timestamps of %s, got %v after %v", field, parsed, previous[field])
+			}
+			previous[field] = parsed
+		}
+	}
+
+	// The preserve profile maps the earliest and latest originals to the start and the end of the duration
+	first := records[0].(map[string]interface{})["time"]
+	last := records[len(records)-1].(map[string]interface{})["time"]
+	if first != 1700000000.0 || last != 1700003600.0 {
+		t.Fatalf("expected the first and last timestamps at 1700000000 and 1700003600, got %v and %v", first, last)
+	}
+}
+
+// Test timestamp rules of the preserve profile on the elements of an array of a document in stream mode,
+// whose original timestamps are scanned in the same parts as the document is processed
+func TestReplacePreserveStream(t *testing.T) {
+	inputPath := "json_replace_tests/case32/input.json"
+	rulePath := "json_replace_tests/case32/rules.json"
+
+	var outputs [][]byte
+	for _, stream := range []bool{false, true} {
+		outputPath := "json_replace_tests/case32/output.json"
+		if stream {
+			outputPath = "json_replace_tests/case32/output_stream.json"
+		}
+		cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, false, 1)
+		cfg.SetStream(stream)
+		replace, err := json_replace.NewJSONReplace(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = replace.Exec()
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, output)
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatalf("expected the same output in stream mode, got %s and %s", outputs[0], outputs[1])
+	}
+
+	// The first and the last original timestamps are mapped to the start and the end of the duration
+	var document struct {
+		Events []struct {
+			Time float64 `json:"time"`
+		} `json:"events"`
+	}
+	err := json.Unmarshal(outputs[1], &document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(document.Events) != 5 || document.Events[0].Time != 1700000000 || document.Events[4].Time != 1700003600 {
+		t.Fatalf("expected preserved timestamps from the start to the end, got %s", outputs[1])
+	}
+}
+
+// Test reproducible mode assigning the same timestamps in two concurrent runs
+func TestReplaceReproducible(t *testing.T) {
+	inputPath := "json_replace_tests/case22/inputs"
+	rulePath := "json_replace_tests/case22/rules.json"
+
+	var outputs [][]byte
+	for _, outputPath := range []string{"json_replace_tests/case22/output1", "json_replace_tests/case22/output2"} {
+		cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+		cfg.SetReproducible(true)
+		replace, err := json_replace.NewJSONReplace(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = replace.Exec()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := os.ReadFile(outputPath + "/b/d.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, output)
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatal("timestamps differ between runs")
+	}
+}
+
+// Test replay mode emitting records to a file at their replay times
+func TestReplaceReplay(t *testing.T) {
+	inputPath := "json_replace_tests/case23/input.txt"
+	outputPath := "json_replace_tests/case23/output.txt"
+	rulePath := "json_replace_tests/case23/rules.json"
+	replayPath := "json_replace_tests/case23/output_replay.txt"
+	os.Remove(replayPath)
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 1)
+	cfg.SetReplay(replayPath, 2)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := os.ReadFile(replayPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(replayed, []byte("\n")); lines != 5 {
+		t.Fatalf("expected 5 replayed records, got %d", lines)
+	}
+	if _, err = os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Fatal("expected no output file in replay mode")
+	}
+}
+
+// Test validate mode reporting every problem of a rule file with its JSON pointer
+func TestReplaceValidate(t *testing.T) {
+	inputPath := "json_replace_tests/case24/input.txt"
+	outputPath := "json_replace_tests/case24/output.txt"
+	rulePath := "json_replace_tests/case24/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 1)
+	cfg.SetValidate(true)
+	_, err := json_replace.NewJSONReplace(cfg)
+	var validateErr *json_error.ValidationError
+	if !errors.As(err, &validateErr) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	expected := []string{
+		"/0/type",
+		"/1/field-name",
+		"/2/order",
+		"/2/original",
+		"/3/colour",
+		"/3/max-records",
+		"/4/when/0/values/0",
+		"/5/order",
+	}
+	if len(validateErr.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), err)
+	}
+	for i, p := range validateErr.Problems {
+		if p.Pointer != expected[i] {
+			t.Fatalf("expected problem at %s, got %v", expected[i], err)
+		}
+	}
+
+	// Without validate mode, an invalid rule file is also located
+	cfg.SetValidate(false)
+	_, err = json_replace.NewJSONReplace(cfg)
+	if !errors.As(err, &validateErr) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	// Detokenize mode checks the vault instead of the rule file, and unknown modes are reported
+	cfg.SetValidate(true)
+	cfg.SetMode(json_replace.ModeDetokenize)
+	cfg.SetVault("json_replace_tests/case24/missing.vault", "")
+	_, err = json_replace.NewJSONReplace(cfg)
+	if !errors.As(err, &validateErr) || len(validateErr.Problems) != 2 ||
+		validateErr.Problems[0].Flag != "-v" || validateErr.Problems[1].Flag != "-k" {
+		t.Fatalf("expected problems of the vault path and key, got %v", err)
+	}
+	cfg.SetMode("restore")
+	_, err = json_replace.NewJSONReplace(cfg)
+	if !errors.As(err, &validateErr) || len(validateErr.Problems) != 1 || validateErr.Problems[0].Flag != "-m" {
+		t.Fatalf("expected a problem of the mode, got %v", err)
+	}
+}
+
+// Test a rule file in YAML format including shared definitions and rules
+func TestReplaceYAML(t *testing.T) {
+	inputPath := "json_replace_tests/case25/input.txt"
+	outputPath := "json_replace_tests/case25/output.txt"
+	rulePath := "json_replace_tests/case25/rules.yaml"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 1)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(output, []byte("\n"))
+	if bytes.Contains(lines[0], []byte("a@example.com")) || !bytes.Contains(lines[1], []byte("b@other.com")) {
+		t.Fatalf("expected only emails of staff to be hashed, got %s", output)
+	}
+	if bytes.Count(output, []byte("[PHONE]")) != 1 || bytes.Contains(lines[2], []byte("ssn")) {
+		t.Fatalf("expected included and referenced rules to apply, got %s", output)
+	}
+}
+
+// Test dry-run mode reporting the impact of each rule without writing outputs
+func TestReplaceDryRun(t *testing.T) {
+	inputPath := "json_replace_tests/case26/input.txt"
+	outputPath := "json_replace_tests/case26/output.txt"
+	rulePath := "json_replace_tests/case26/rules.json"
+	reportPath := "json_replace_tests/case26/output_report.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 1)
+	cfg.SetDryRun(reportPath)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Fatal("expected no output file in dry-run mode")
+	}
+
+	content, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report json_replace.Report
+	err = json.Unmarshal(content, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Records and fields changed by the drop-record, hash, remove and per-field rules
+	expected := [][2]int{{1, 0}, {2, 2}, {1, 2}, {0, 0}}
+	if report.Records != 3 || report.Dropped != 1 || len(report.Rules) != len(expected) {
+		t.Fatalf("unexpected report %s", content)
+	}
+	for i, r := range report.Rules {
+		if r.Records != expected[i][0] || r.Fields != expected[i][1] || len(r.Samples) != r.Records {
+			t.Fatalf("unexpected report of rule %d: %s", r.Order, content)
+		}
+	}
+}
+
+// Test the audit log recording every change with hashes of original values
+func TestReplaceAudit(t *testing.T) {
+	inputPath := "json_replace_tests/case27/input.txt"
+	outputPath := "json_replace_tests/case27/output.txt"
+	rulePath := "json_replace_tests/case27/rules.json"
+	auditPath := "json_replace_tests/case27/output_audit.ndjson"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 1)
+	cfg.SetAudit(auditPath, "salt")
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, original := range []string{"alice", "bob", "carol", "Springfield"} {
+		if bytes.Contains(content, []byte(original)) {
+			t.Fatalf("expected no original value in the audit log, got %s", content)
+		}
+	}
+
+	// Changes in the order of lines and rules, where the first element of an array is removed
+	// and a value is replaced with an equal value
+	expected := []json_replace.AuditEntry{
+		{Line: 1, Path: "user.email", Rule: 2, Action: "replace"},
+		{Line: 1, Path: "user.address.city", Rule: 3, Action: "remove"},
+		{Line: 1, Path: "user.address.street", Rule: 3, Action: "remove"},
+		{Line: 1, Path: "time", Rule: 4, Action: "add"},
+		{Line: 2, Path: "user.email", Rule: 2, Action: "replace"},
+		{Line: 2, Path: "time", Rule: 4, Action: "replace"},
+		{Line: 3, Path: "", Rule: 1, Action: "drop"},
+		{Line: 4, Path: "user.email", Rule: 2, Action: "replace"},
+		{Line: 4, Path: "time", Rule: 4, Action: "add"},
+		{Line: 4, Path: "tags[0]", Rule: 5, Action: "remove"},
+		{Line: 4, Path: "level", Rule: 6, Action: "replace"},
+	}
+	lines := bytes.Split(bytes.TrimSpace(content), []byte("\n"))
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d entries, got %s", len(expected), content)
+	}
+	for i, line := range lines {
+		var entry json_replace.AuditEntry
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := expected[i]
+		if entry.File != inputPath || entry.Line != e.Line || entry.Path != e.Path || entry.Rule != e.Rule || entry.Action != e.Action {
+			t.Fatalf("expected entry %v, got %s", e, line)
+		}
+		if (entry.OriginalHash == "") != (e.Action == "add") {
+			t.Fatalf("expected a hash of the original value unless added, got %s", line)
+		}
+	}
+}
+
+// Test fake rules seeded by the entity of the record or by the original value in line-by-line mode
+func TestReplaceFake(t *testing.T) {
+	inputPath := "json_replace_tests/case28/input.txt"
+	outputPath := "json_replace_tests/case28/output.txt"
+	rulePath := "json_replace_tests/case28/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 1)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+		var record map[string]interface{}
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %s", content)
+	}
+	first, second, third := records[0], records[1], records[2]
+
+	// Records of the same entity get the same fake identity, whose email matches its name
+	name, _ := first["name"].(string)
+	email, _ := first["email"].(string)
+	if name == "Alice Liddell" || name != third["name"] || email != third["email"] || name == second["name"] {
+		t.Fatalf("expected the same fake identity of the same entity only, got %s", content)
+	}
+	if !strings.HasPrefix(email, strings.ToLower(strings.Replace(name, " ", ".", 1))+"@") {
+		t.Fatalf("expected the fake email of the fake name, got %s", content)
+	}
+
+	// Values without entity are seeded by themselves, and null is kept
+	if first["company"] == "Looking Glass Ltd" || first["company"] != second["company"] || third["company"] != nil {
+		t.Fatalf("expected the same fake company of the same value, got %s", content)
+	}
+	ip, _ := first["ip"].(string)
+	ipv6, _ := second["ip"].(string)
+	if !strings.HasPrefix(ip, "10.") || ip != third["ip"] || !strings.HasPrefix(ipv6, "fd") {
+		t.Fatalf("expected fake private addresses, got %s", content)
+	}
+	id, _ := first["id"].(string)
+	if len(id) != 36 || id != third["id"] || id == second["id"] {
+		t.Fatalf("expected fake UUIDs of numbers, got %s", content)
+	}
+}
+
+// Test compressed and plain input files with compressed output files, with and without stream mode
+func TestReplaceCompressed(t *testing.T) {
+	inputPath := "json_replace_tests/case29/input"
+	rulePath := "json_replace_tests/case29/rules.json"
+
+	for _, stream := range []bool{false, true} {
+		outputPath := "json_replace_tests/case29/output"
+		if stream {
+			outputPath = "json_replace_tests/case29/output_stream"
+		}
+		cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+		cfg.SetStream(stream)
+		cfg.SetCompress(json_compress.Gzip)
+		replace, err := json_replace.NewJSONReplace(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = replace.Exec()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The extension of compressed inputs is replaced, and added to plain inputs
+		expected := map[string]int{"events.json.gz": 2, "plain.json.gz": 1, "archive.json.gz": 1}
+		for name, records := range expected {
+			f, err := os.Open(outputPath + "/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(reader)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := bytes.Split(bytes.TrimSpace(content), []byte("\n"))
+			if len(lines) != records || bytes.Contains(content, []byte("@example.com")) {
+				t.Fatalf("expected %d records with hashed emails in %s, got %s", records, name, content)
+			}
+		}
+	}
+}
+
+// Test output files compressed by zstd, and an output file given explicitly which is written as it is
+func TestReplaceZstd(t *testing.T) {
+	inputPath := "json_replace_tests/case29/input"
+	outputPath := "json_replace_tests/case29/output_zstd"
+	rulePath := "json_replace_tests/case29/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	cfg.SetCompress(json_compress.Zstd)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{"events.json.zst": 2, "plain.json.zst": 1, "archive.json.zst": 1}
+	for name, records := range expected {
+		raw, err := os.ReadFile(outputPath + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(raw, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+			t.Fatalf("expected %s to be compressed by zstd", name)
+		}
+		content, err := json_compress.ReadFile(outputPath + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := bytes.Split(bytes.TrimSpace(content), []byte("\n"))
+		if len(lines) != records || bytes.Contains(content, []byte("@example.com")) {
+			t.Fatalf("expected %d records with hashed emails in %s, got %s", records, name, content)
+		}
+	}
+
+	// The extension of an output file given explicitly is kept although outputs are not compressed
+	explicitPath := "json_replace_tests/case29/output_explicit.json.gz"
+	cfg = json_replace.NewConfig(inputPath+"/archive.json.zst", explicitPath, rulePath, true, 10)
+	replace, err = json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(explicitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(content, []byte("{")) || bytes.Contains(content, []byte("@example.com")) {
+		t.Fatalf("expected a plain record with a hashed email in %s, got %s", explicitPath, content)
+	}
+
+	// Unknown formats of compression are rejected
+	cfg = json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	cfg.SetCompress("lz4")
+	_, err = json_replace.NewJSONReplace(cfg)
+	var configErr *json_error.ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a config error of an unknown format of compression, got %v", err)
+	}
+}
+
+// Test reading records from stdin and writing them to stdout, which requires line-by-line mode
+// and is not allowed in reproducible mode
+func TestReplaceStdio(t *testing.T) {
+	inputPath := "json_replace_tests/case27/input.txt"
+	outputPath := "json_replace_tests/case27/output_stdout.txt"
+	rulePath := "json_replace_tests/case27/rules.json"
+
+	cfg := json_replace.NewConfig("-", "-", rulePath, true, 10)
+	cfg.SetReproducible(true)
+	_, err := json_replace.NewJSONReplace(cfg)
+	var configErr *json_error.ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a config error of reading stdin in reproducible mode, got %v", err)
+	}
+
+	cfg = json_replace.NewConfig("-", "-", rulePath, false, 10)
+	_, err = json_replace.NewJSONReplace(cfg)
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a config error of stdin and stdout without line-by-line mode, got %v", err)
+	}
+
+	cfg = json_replace.NewConfig("-", "-", rulePath, true, 10)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := redirect(t, inputPath, outputPath)
+	err = replace.Exec()
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Records are processed line by line, and the dropped record is not written
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n"))
+	if len(lines) != 3 || bytes.Contains(content, []byte("@example.com")) {
+		t.Fatalf("expected 3 records with hashed emails, got %s", content)
+	}
+
+	// Records larger than the buffer of stdout from files processed concurrently are written as whole lines
+	inputPath = "json_replace_tests/case27/output_inputs"
+	err = os.MkdirAll(inputPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		record := `{"user": {"email": "` + name + `@example.com"}, "padding": "` + strings.Repeat(name, 8192) + `"}` + "\n"
+		err = os.WriteFile(inputPath+"/"+name+".txt", []byte(strings.Repeat(record, 50)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg = json_replace.NewConfig(inputPath, "-", rulePath, true, 10)
+	replace, err = json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore = redirect(t, "json_replace_tests/case27/input.txt", outputPath)
+	err = replace.Exec()
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err = os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n"))
+	if len(lines) != 200 {
+		t.Fatalf("expected 200 records, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if !json.Valid(line) {
+			t.Fatalf("expected whole records, got %.100s", line)
+		}
+	}
+}
+
+// Test hash and tokenize rules telling apart integers beyond the precision of float64 in faithful mode,
+// and detokenize restoring them with all their digits
+func TestReplaceLargeNumbers(t *testing.T) {
+	inputPath := "json_replace_tests/case30/input.txt"
+	outputPath := "json_replace_tests/case30/output.txt"
+	rulePath := "json_replace_tests/case30/rules.json"
+
+	cfg := json_replace.NewConfig(inputPath, outputPath, rulePath, true, 10)
+	cfg.SetFaithful(true, false)
+	replace, err := json_replace.NewJSONReplace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replace.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]bool{}
+	accounts := map[string]bool{}
+	for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+		var record map[string]string
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[record["id"]] = true
+		accounts[record["account"]] = true
+	}
+	if len(ids) != 3 || len(accounts) != 3 {
+		t.Fatalf("expected 3 distinct tokens and hashes, got %s", content)
+	}
+
+	inputPath = outputPath
+	outputPath = "json_replace_tests/case30/output_restored.txt"
+	vaultPath := "json_replace_tests/case30/output.vault"
+
+	cfg = json_replace.NewDetokenizeConfig(inputPath, outputPath, vaultPath, "change-me", true, 10)
+	cfg.SetFaithful(true, false)
+	detokenize, err := json_replace.NewJSONDetokenize(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = detokenize.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{`"id":9007199254740993`, `"id":9007199254740992`, `"id":12345678901234567891`} {
+		if !bytes.Contains(restored, []byte(id)) {
+			t.Fatalf("expected %s to be restored, got %s", id, restored)
+		}
+	}
+}
+
+// Redirect stdin from the input file and stdout to the output file, and return the function restoring them
+func redirect(t *testing.T, inputPath string, outputPath string) func() {
+	stdin, stdout := os.Stdin, os.Stdout
+	input, err := os.Open(inputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := os.Create(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdin, os.Stdout = input, output
+	return func() {
+		os.Stdin, os.Stdout = stdin, stdout
+		input.Close()
+		output.Close()
+	}
+}
+
+// Compare an output file with the file of its expected content
+func compareOutput(t *testing.T, outputPath string, expectedPath string) {
+	t.Helper()
+	output, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile(expectedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, expected) {
+		t.Fatalf("expected %s to be the same as %s, got:\n%s", outputPath, expectedPath, output)
+	}
+}
+
+// Return the number of leading bits two IP addresses have in common
+func commonPrefix(a string, b string) int {
+	x, y := net.ParseIP(a), net.ParseIP(b)
+	for i := range x {
+		if d := x[i] ^ y[i]; d != 0 {
+			return i*8 + bits.LeadingZeros8(d)
+		}
+	}
+	return len(x) * 8
+}
+
+// Read the records of a file in line-by-line mode
+func readRecords(t *testing.T, path string) []interface{} {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+		var record interface{}
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
 }
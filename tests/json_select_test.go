@@ -1,7 +1,15 @@
 package tests
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/Joker-Jane/JSON-replacement/json_compress"
+	"github.com/Joker-Jane/JSON-replacement/json_error"
 	"github.com/Joker-Jane/JSON-replacement/json_select"
+	"io"
+	"os"
 	"testing"
 )
 
@@ -12,8 +20,14 @@ func TestSelectMatch01(t *testing.T) {
 	rulePath := "json_select_tests/case1/rules.json"
 
 	cfg := json_select.NewDefaultConfig(inputPath, outputPath, rulePath)
-	s := json_select.NewJSONSelect(cfg)
-	s.Exec()
+	s, err := json_select.NewJSONSelect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 // Test another simple input with standard input
@@ -23,8 +37,14 @@ func TestSelectMatch02(t *testing.T) {
 	rulePath := "json_select_tests/case2/rules.json"
 
 	cfg := json_select.NewDefaultConfig(inputPath, outputPath, rulePath)
-	s := json_select.NewJSONSelect(cfg)
-	s.Exec()
+	s, err := json_select.NewJSONSelect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 // Test another simple input with standard input
@@ -34,8 +54,36 @@ func TestSelectTypes(t *testing.T) {
 	rulePath := "json_select_tests/case3/rules.json"
 
 	cfg := json_select.NewDefaultConfig(inputPath, outputPath, rulePath)
-	s := json_select.NewJSONSelect(cfg)
-	s.Exec()
+	s, err := json_select.NewJSONSelect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test wildcard, recursive, index and quoted path selectors
+func TestSelectPath(t *testing.T) {
+	inputPath := "json_select_tests/case5/input"
+	outputPath := "json_select_tests/case5/output"
+	rulePath := "json_select_tests/case5/rules.json"
+
+	cfg := json_select.NewDefaultConfig(inputPath, outputPath, rulePath)
+	s, err := json_select.NewJSONSelect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each record is selected by exactly one rule
+	for _, name := range []string{"stream_1", "stream_2", "stream_3", "default", "drop"} {
+		compareOutput(t, outputPath+"/"+name, "json_select_tests/case5/expected/"+name)
+	}
 }
 
 /*
@@ -46,7 +94,189 @@ func TestSelectMassive(t *testing.T) {
 	rulePath := "json_select_tests/case4/rules.json"
 
 	cfg := json_select.NewDefaultConfig(inputPath, outputPath, rulePath)
-	s := json_select.NewJSONSelect(cfg)
-	s.Exec()
+	s, err := json_select.NewJSONSelect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 */
+
+// Test validate mode reporting every problem of a rule file with its JSON pointer
+func TestSelectValidate(t *testing.T) {
+	inputPath := "json_select_tests/case6/input.txt"
+	outputPath := "json_select_tests/case6/output"
+	rulePath := "json_select_tests/case6/rules.json"
+
+	cfg := json_select.NewDefaultConfig(inputPath, outputPath, rulePath)
+	cfg.SetValidate(true)
+	_, err := json_select.NewJSONSelect(cfg)
+	var validateErr *json_error.ValidationError
+	if !errors.As(err, &validateErr) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	expected := []string{
+		"/2/conditions/0/type",
+		"/2/position",
+		"/3/conditions/0/values/0",
+		"/2/output",
+		"/3",
+	}
+	if len(validateErr.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), err)
+	}
+	for i, p := range validateErr.Problems {
+		if p.Pointer != expected[i] {
+			t.Fatalf("expected problem at %s, got %v", expected[i], err)
+		}
+	}
+}
+
+// Test a rule file in YAML format referencing conditions defined in an included file
+func TestSelectYAML(t *testing.T) {
+	inputPath := "json_select_tests/case7/input.txt"
+	outputPath := "json_select_tests/case7/output"
+	rulePath := "json_select_tests/case7/rules.yml"
+
+	cfg := json_select.NewConfig(inputPath, outputPath, rulePath, 1)
+	s, err := json_select.NewJSONSelect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for output, expected := range map[string]string{"api_errors": "api", "errors": "db", "default": "info"} {
+		content, err := os.ReadFile(outputPath + "/" + output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Count(content, []byte("\n")) != 1 || !bytes.Contains(content, []byte(expected)) {
+			t.Fatalf("expected the record of %s in %s, got %s", expected, output, content)
+		}
+	}
+}
+
+// Test dry-run mode reporting the records matched by each rule without writing outputs
+func TestSelectDryRun(t *testing.T) {
+	inputPath := "json_select_tests/case7/input.txt"
+	outputPath := "json_select_tests/case7/output_dry_run"
+	rulePath := "json_select_tests/case7/rules.yml"
+	reportPath := "json_select_tests/case7/output_report.json"
+
+	cfg := json_select.NewConfig(inputPath, outputPath, rulePath, 1)
+	cfg.SetDryRun(reportPath)
+	s, err := json_select.NewJSONSelect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Fatal("expected no output directory in dry-run mode")
+	}
+
+	content, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report json_select.Report
+	err = json.Unmarshal(content, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 3 || len(report.Rules) != 2 || report.Default.Records != 1 {
+		t.Fatalf("unexpected report %s", content)
+	}
+	for _, r := range report.Rules {
+		if r.Records != 1 || r.Files[inputPath] != 1 || len(r.Samples) != 1 {
+			t.Fatalf("unexpected report of rule %d: %s", r.Position, content)
+		}
+	}
+}
+
+// Test a bzip2 compressed input file with compressed output files
+func TestSelectCompressed(t *testing.T) {
+	inputPath := "json_select_tests/case8/input"
+	outputPath := "json_select_tests/case8/output"
+	rulePath := "json_select_tests/case8/rules.json"
+
+	cfg := json_select.NewDefaultConfig(inputPath, outputPath, rulePath)
+	cfg.SetCompress(json_compress.Gzip)
+	s, err := json_select.NewJSONSelect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{"staff.gz": 1, "default.gz": 2, "drop.gz": 0}
+	for name, records := range expected {
+		f, err := os.Open(outputPath + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(reader)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Count(content, []byte("\n")) != records {
+			t.Fatalf("expected %d records in %s, got %s", records, name, content)
+		}
+	}
+}
+
+// Test reading compressed records from stdin and writing them to stdout with the tags of their outputs
+func TestSelectStdio(t *testing.T) {
+	inputPath := "json_select_tests/case8/input/events.json.bz2"
+	outputPath := "json_select_tests/case8/output_stdout.txt"
+	rulePath := "json_select_tests/case8/rules.json"
+
+	cfg := json_select.NewDefaultConfig("-", "-", rulePath)
+	s, err := json_select.NewJSONSelect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := redirect(t, inputPath, outputPath)
+	err = s.Exec()
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := map[string]int{}
+	for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+		var record map[string]interface{}
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, found := record["user"]; !found {
+			t.Fatalf("expected the fields of the record, got %s", line)
+		}
+		output, _ := record[json_select.TagKey].(string)
+		outputs[output]++
+	}
+	if len(outputs) != 2 || outputs["staff"] != 1 || outputs["default"] != 2 {
+		t.Fatalf("expected records tagged with their outputs, got %s", content)
+	}
+}